@@ -0,0 +1,213 @@
+package moesifgin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyContextKey            = "moesif.apiKey"
+	defaultAPIKeyPrefixLength   = 6
+	defaultAPIKeyOwnerCacheSize = 1024
+)
+
+// APIKeyOwner is the user and company an API key belongs to
+type APIKeyOwner struct {
+	UserId    string
+	CompanyId string
+}
+
+// apiKeyConfig is set by the API_Key_* options, nil when API key detection is disabled
+type apiKeyConfig struct {
+	locations    []apiKeyLocation
+	secret       []byte
+	prefixLength int
+	owners       map[string]APIKeyOwner
+	resolve      func(apiKey string) APIKeyOwner
+	cache        *lruCache
+}
+
+// apiKeyLocation is where a request may carry its API key
+type apiKeyLocation struct {
+	kind string // header, query or basic
+	name string
+}
+
+var apiKeyIdentity *apiKeyConfig
+
+// apiKey is the API key detected on a request
+type apiKey struct {
+	sessionToken string
+	owner        APIKeyOwner
+	location     apiKeyLocation
+}
+
+// apiKeyOption reads the API_Key_* options
+func apiKeyOption(moesifOption map[string]interface{}) *apiKeyConfig {
+	specs, found := moesifOption["API_Key_Locations"].([]string)
+	if !found || len(specs) == 0 {
+		return nil
+	}
+	config := &apiKeyConfig{
+		prefixLength: defaultAPIKeyPrefixLength,
+		cache:        newLRUCache(defaultAPIKeyOwnerCacheSize),
+	}
+	for _, spec := range specs {
+		kind, name, _ := strings.Cut(spec, ":")
+		switch kind {
+		case "header":
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		case "query", "basic":
+		default:
+			logger.Error("Ignoring invalid API key location", "location", spec)
+			continue
+		}
+		config.locations = append(config.locations, apiKeyLocation{kind: kind, name: name})
+	}
+
+	switch secret := moesifOption["API_Key_Hash_Secret"].(type) {
+	case string:
+		config.secret = []byte(secret)
+	case []byte:
+		config.secret = secret
+	}
+	if len(config.secret) == 0 {
+		logger.Warn("API_Key_Hash_Secret is not set, API keys are hashed without a key")
+	}
+	if length, found := moesifOption["API_Key_Prefix_Length"].(int); found && length >= 0 {
+		config.prefixLength = length
+	}
+	config.owners, _ = moesifOption["API_Key_Owners"].(map[string]APIKeyOwner)
+	config.resolve, _ = moesifOption["Resolve_API_Key"].(func(apiKey string) APIKeyOwner)
+	if size, found := moesifOption["API_Key_Cache_Size"].(int); found && size > 0 {
+		config.cache = newLRUCache(size)
+	}
+	return config
+}
+
+// find returns the first API key carried by the request and where it was found
+func (a *apiKeyConfig) find(c *gin.Context) (string, apiKeyLocation) {
+	for _, location := range a.locations {
+		var key string
+		switch location.kind {
+		case "header":
+			key = c.Request.Header.Get(location.name)
+			// Strip an authentication scheme, e.g. "ApiKey abc"
+			if _, credentials, found := strings.Cut(key, " "); found && strings.EqualFold(location.name, "Authorization") {
+				key = credentials
+			}
+		case "query":
+			key = c.Query(location.name)
+		case "basic":
+			if username, password, ok := c.Request.BasicAuth(); ok {
+				key = username
+				if location.name == "password" {
+					key = password
+				}
+			}
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			return key, location
+		}
+	}
+	return "", apiKeyLocation{}
+}
+
+// sessionToken derives a stable token from the key that cannot be reversed: its prefix,
+// which usually tells the key type or environment apart, and a keyed hash of the key
+func (a *apiKeyConfig) sessionToken(key string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(key))
+	digest := hex.EncodeToString(mac.Sum(nil))[:32]
+	prefix := key
+	if len(prefix) > a.prefixLength {
+		prefix = prefix[:a.prefixLength]
+	}
+	if prefix == "" {
+		return digest
+	}
+	return prefix + "." + digest
+}
+
+// owner resolves the user and company of a key from the lookup table or the callback.
+// Callback results are cached by session token, so raw keys are not kept.
+func (a *apiKeyConfig) owner(key string, sessionToken string) APIKeyOwner {
+	if owner, found := a.owners[key]; found {
+		return owner
+	}
+	if a.resolve == nil {
+		return APIKeyOwner{}
+	}
+	if cached, found := a.cache.get(sessionToken); found {
+		return cached.(APIKeyOwner)
+	}
+	owner := a.resolve(key)
+	a.cache.add(sessionToken, owner)
+	return owner
+}
+
+// apiKey returns the API key of the request, detecting it once per request
+func (a *apiKeyConfig) apiKey(c *gin.Context) *apiKey {
+	if value, found := c.Get(apiKeyContextKey); found {
+		detected, _ := value.(*apiKey)
+		return detected
+	}
+	var detected *apiKey
+	if key, location := a.find(c); key != "" {
+		token := a.sessionToken(key)
+		detected = &apiKey{sessionToken: token, owner: a.owner(key, token), location: location}
+	}
+	c.Set(apiKeyContextKey, detected)
+	return detected
+}
+
+// apiKeyField returns the user id, company id or session token from the request's API key
+func apiKeyField(fieldName string, c *gin.Context) string {
+	if apiKeyIdentity == nil {
+		return ""
+	}
+	detected := apiKeyIdentity.apiKey(c)
+	if detected == nil {
+		return ""
+	}
+	switch fieldName {
+	case "Identify_User":
+		return detected.owner.UserId
+	case "Identify_Company":
+		return detected.owner.CompanyId
+	case "Get_Session_Token":
+		return detected.sessionToken
+	}
+	return ""
+}
+
+// redactAPIKey removes the API key of the request from the captured event: the header it
+// was found in is masked and the query parameter is removed from the URI
+func redactAPIKey(c *gin.Context, captured *capturedEvent) {
+	if apiKeyIdentity == nil {
+		return
+	}
+	detected := apiKeyIdentity.apiKey(c)
+	if detected == nil {
+		return
+	}
+	switch detected.location.kind {
+	case "header":
+		captured.reqHeader = maskData(captured.reqHeader, []string{detected.location.name})
+	case "basic":
+		captured.reqHeader = maskData(captured.reqHeader, []string{"Authorization"})
+	case "query":
+		url := *captured.request.URL
+		query := url.Query()
+		query.Del(detected.location.name)
+		url.RawQuery = query.Encode()
+		// Shallow copy, so the request itself is not modified
+		captured.request = captured.request.WithContext(captured.request.Context())
+		captured.request.URL = &url
+	}
+}
@@ -0,0 +1,63 @@
+package moesifgin
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIKeyIsRedacted(t *testing.T) {
+	const secret = "sk_live_SECRET"
+	tests := []struct {
+		name   string
+		path   string
+		header string
+	}{
+		{name: "header", path: "/orders", header: "X-Api-Key"},
+		{name: "query", path: "/orders?api_key=" + secret + "&page=2"},
+		{name: "authorization", path: "/orders", header: "Authorization"},
+		{name: "basic", path: "/orders", header: "basic"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{
+				"API_Key_Locations":   []string{"header:X-Api-Key", "query:api_key", "basic:username", "header:Authorization"},
+				"API_Key_Hash_Secret": "hash-secret",
+			})
+			r.GET("/orders", func(c *gin.Context) { c.String(200, "ok") })
+
+			req := httptest.NewRequest("GET", test.path, nil)
+			switch test.header {
+			case "basic":
+				req.SetBasicAuth(secret, "")
+			case "Authorization":
+				req.Header.Set("Authorization", "ApiKey "+secret)
+			case "":
+			default:
+				req.Header.Set(test.header, secret)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			encoded, err := json.Marshal(events[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(encoded), secret) {
+				t.Errorf("event contains the API key: %s", encoded)
+			}
+			if token := *events[0].SessionToken; !strings.HasPrefix(token, "sk_liv.") {
+				t.Errorf("session token = %q, want the hashed key", token)
+			}
+			if test.name == "query" && !strings.HasSuffix(events[0].Request.Uri, "/orders?page=2") {
+				t.Errorf("uri = %q, want the other query parameters kept", events[0].Request.Uri)
+			}
+		})
+	}
+}
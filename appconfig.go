@@ -3,8 +3,9 @@ package moesifgin
 import (
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type AppConfig struct {
@@ -12,15 +13,25 @@ type AppConfig struct {
 	Updates chan string
 	eTags   [2]string
 	config  AppConfigResponse
+	stop    chan struct{}
+	done    chan struct{}
 }
 
 func NewAppConfig() AppConfig {
 	return AppConfig{
 		Updates: make(chan string, 1),
 		config:  NewAppConfigResponse(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
 
+// newAppConfig returns a config that is not shared with an earlier update loop
+func newAppConfig() *AppConfig {
+	config := NewAppConfig()
+	return &config
+}
+
 func (c *AppConfig) Read() AppConfigResponse {
 	c.Mu.RLock()
 	defer c.Mu.RUnlock()
@@ -36,10 +47,19 @@ func (c *AppConfig) Write(config AppConfigResponse) {
 }
 
 func (c *AppConfig) Go() {
-	go c.UpdateLoop()
+	go func() {
+		defer close(c.done)
+		c.UpdateLoop()
+	}()
 	c.Notify("go")
 }
 
+// close stops the update loop started by Go and waits for a fetch in progress
+func (c *AppConfig) close() {
+	close(c.stop)
+	<-c.done
+}
+
 func (c *AppConfig) Notify(eTag string) {
 	c.Mu.RLock()
 	e := c.eTags
@@ -55,17 +75,35 @@ func (c *AppConfig) Notify(eTag string) {
 
 func (c *AppConfig) UpdateLoop() {
 	for {
-		eTag, more := <-c.Updates
+		var eTag string
+		var more bool
+		select {
+		case eTag, more = <-c.Updates:
+		case <-c.stop:
+			return
+		}
 		if !more {
 			return
 		}
-		config, err := getAppConfig()
+		var config AppConfigResponse
+		err := withRetry(func() (err error) {
+			config, err = getAppConfig()
+			return
+		})
 		if err != nil {
-			log.Printf("Failed to get config: %v", err)
+			// Try again later, the next events response may not carry a new ETag
+			wait := breaker.wait()
+			if wait < defaultCircuitBreakerCooldown {
+				wait = defaultCircuitBreakerCooldown
+			}
+			atomic.AddInt64(&metrics.configRefreshFailures, 1)
+			logger.Warn("Failed to get application config, retrying", "retry_in", wait, "error", err)
+			time.AfterFunc(wait, func() { c.Notify(eTag) })
 			continue
 		}
-		log.Printf("AppConfig.Notify ETag=%s got /config response ETag=%s", eTag, config.eTag)
+		logger.Debug("Application config updated", "notified_etag", eTag, "etag", config.eTag)
 		c.Write(config)
+		atomic.AddInt64(&metrics.configRefreshes, 1)
 	}
 }
 
@@ -117,17 +155,23 @@ func getAppConfig() (config AppConfigResponse, err error) {
 	config = NewAppConfigResponse()
 	r, err := apiClient.GetAppConfig()
 	if err != nil {
-		log.Printf("Application configuration request error: %v", err)
+		logger.Warn("Application config request failed", "error", err)
+		return
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		err = newCollectorError("/v1/config", r)
+		logger.Warn("Application config request failed", "error", err)
 		return
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Application configuration response body read error: %v", err)
+		logger.Warn("Application config response could not be read", "error", err)
 		return
 	}
 	err = json.Unmarshal(body, &config)
 	if err != nil {
-		log.Printf("Application configuration response body malformed: %v", err)
+		logger.Warn("Application config response is malformed", "error", err)
 		return
 	}
 	config.eTag = r.Header.Get("X-Moesif-Config-Etag")
@@ -0,0 +1,62 @@
+package moesifgin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// cancelWatch records when the request context was canceled while the handlers ran,
+// which usually means the client went away
+type cancelWatch struct {
+	mu    sync.Mutex
+	at    time.Time
+	err   error
+	stop  func() bool
+	fired chan struct{}
+}
+
+// watchCancel starts watching ctx until done is called, without a goroutine per request
+func watchCancel(ctx context.Context) *cancelWatch {
+	w := &cancelWatch{fired: make(chan struct{})}
+	w.stop = context.AfterFunc(ctx, func() {
+		defer close(w.fired)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.at = time.Now()
+		w.err = ctx.Err()
+	})
+	return w
+}
+
+// done stops watching, cancellation after the handlers returned is not recorded. If ctx
+// was canceled already, it waits until the cancellation is recorded.
+func (w *cancelWatch) done() {
+	if !w.stop() {
+		<-w.fired
+	}
+}
+
+// observe records the expired deadline of a context that replaced the request context
+// while the handlers ran. Other cancellations are ignored, as handlers commonly cancel
+// the contexts they create before returning.
+func (w *cancelWatch) observe(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return
+	}
+	w.at = time.Now()
+	if deadline, ok := ctx.Deadline(); ok {
+		w.at = deadline
+	}
+	w.err = ctx.Err()
+}
+
+// result returns when and why the context was canceled, or a nil error if it was not
+func (w *cancelWatch) result() (time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.at, w.err
+}
@@ -0,0 +1,99 @@
+package moesifgin
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCancellationMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		// handler runs as the route handler, with cancel canceling the request context
+		handler     func(c *gin.Context, cancel context.CancelFunc)
+		deadline    time.Duration
+		wantKey     string
+		wantElapsed time.Duration
+	}{
+		{
+			name:    "completed",
+			handler: func(c *gin.Context, cancel context.CancelFunc) { c.String(200, "ok") },
+		},
+		{
+			name: "client canceled mid-handler",
+			handler: func(c *gin.Context, cancel context.CancelFunc) {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			},
+			wantKey:     "client_aborted",
+			wantElapsed: 10 * time.Millisecond,
+		},
+		{
+			name: "request deadline",
+			handler: func(c *gin.Context, cancel context.CancelFunc) {
+				<-c.Request.Context().Done()
+			},
+			deadline:    10 * time.Millisecond,
+			wantKey:     "timed_out",
+			wantElapsed: 10 * time.Millisecond,
+		},
+		{
+			name: "deadline set by a handler",
+			handler: func(c *gin.Context, cancel context.CancelFunc) {
+				ctx, cancelTimeout := context.WithTimeout(c.Request.Context(), 10*time.Millisecond)
+				defer cancelTimeout()
+				c.Request = c.Request.WithContext(ctx)
+				<-ctx.Done()
+			},
+			wantKey:     "timed_out",
+			wantElapsed: 10 * time.Millisecond,
+		},
+		{
+			// Handlers commonly cancel the contexts they create before returning
+			name: "context canceled by a handler",
+			handler: func(c *gin.Context, cancel context.CancelFunc) {
+				ctx, cancelChild := context.WithCancel(c.Request.Context())
+				c.Request = c.Request.WithContext(ctx)
+				cancelChild()
+				c.String(200, "ok")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.deadline > 0 {
+				ctx, cancel = context.WithTimeout(ctx, test.deadline)
+				defer cancel()
+			}
+			r.GET("/orders", func(c *gin.Context) { test.handler(c, cancel) })
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil).WithContext(ctx))
+
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			metadata := events[0].Metadata.(map[string]interface{})
+			response, _ := metadata["moesif_response"].(map[string]interface{})
+			for _, key := range []string{"client_aborted", "timed_out"} {
+				if marked := response[key] == true; marked != (key == test.wantKey) {
+					t.Errorf("moesif_response[%s] = %v in %v", key, response[key], response)
+				}
+			}
+			elapsed, found := response["canceled_after_ms"].(float64)
+			if found != (test.wantKey != "") {
+				t.Fatalf("canceled_after_ms = %v in %v", response["canceled_after_ms"], response)
+			}
+			total := metadata["moesif_timing"].(map[string]interface{})["total_ms"].(float64)
+			// The deadline of the request context starts before the middleware does
+			if found && (elapsed < millis(test.wantElapsed/2) || elapsed > total) {
+				t.Errorf("canceled_after_ms = %v, want about %v and at most the total of %v", elapsed, millis(test.wantElapsed), total)
+			}
+		})
+	}
+}
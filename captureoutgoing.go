@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	moesifapi "github.com/moesif/moesifapi-go"
 )
 
 // Transport implements http.RoundTripper.
@@ -52,17 +54,15 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 
 	// Skip / Send event to moesif
 	if shouldSkipOutgoing {
-		if debug {
-			log.Printf("Skip sending the outgoing event to Moesif")
-		}
+		logger.Debug("Skipping outgoing event", "url", request.URL.String(), "reason", "should_skip_outgoing")
+		atomic.AddInt64(&metrics.eventsSkipped, 1)
 	} else {
 
 		// Check if the event is to Moesif
-		if !(strings.Contains(request.URL.String(), "moesif.net")) {
+		if !isMoesifRequest(request) {
+			atomic.AddInt64(&metrics.eventsCaptured, 1)
 
-			if debug {
-				log.Printf("Sending the outgoing event to Moesif")
-			}
+			logger.Debug("Sending outgoing event", "url", request.URL.String())
 
 			// Get Request Body
 			var (
@@ -74,22 +74,18 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 			if logBodyOutgoing && request.Body != nil {
 				copyBody, err := request.GetBody()
 				if err != nil {
-					if debug {
-						log.Printf("Error while getting the outgoing request body: %s.\n", err.Error())
-					}
+					logger.Debug("Could not get outgoing request body", "url", request.URL.String(), "error", err)
 				}
 
 				// Read the request body
 				readReqBody, reqBodyErr := ioutil.ReadAll(copyBody)
 				if reqBodyErr != nil {
-					if debug {
-						log.Printf("Error while reading outgoing request body: %s.\n", reqBodyErr.Error())
-					}
+					logger.Debug("Could not read outgoing request body", "url", request.URL.String(), "error", reqBodyErr)
 				}
 				reqContentLength = getContentLength(request.Header, readReqBody)
 
 				// Parse the request Body
-				outgoingReqBody, reqEncoding = parseBody(readReqBody, "Request_Body_Masks")
+				outgoingReqBody, reqEncoding = parseBody(readReqBody, configuredMasks("Request_Body_Masks"))
 
 				// Return io.ReadCloser while making sure a Close() is available for request body
 				request.Body = ioutil.NopCloser(bytes.NewBuffer(readReqBody))
@@ -107,14 +103,12 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 				// Read the response body
 				readRespBody, err := ioutil.ReadAll(response.Body)
 				if err != nil {
-					if debug {
-						log.Printf("Error while reading outgoing response body: %s.\n", err.Error())
-					}
+					logger.Debug("Could not read outgoing response body", "url", request.URL.String(), "error", err)
 				}
 				respContentLength = getContentLength(response.Header, readRespBody)
 
 				// Parse the response Body
-				outgoingRespBody, respEncoding = parseBody(readRespBody, "Response_Body_Masks")
+				outgoingRespBody, respEncoding = parseBody(readRespBody, configuredMasks("Response_Body_Masks"))
 
 				// Return io.ReadCloser while making sure a Close() is available for response body
 				response.Body = ioutil.NopCloser(bytes.NewBuffer(readRespBody))
@@ -139,27 +133,33 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 
 			// Mask Request Header
 			var requestHeader map[string]interface{}
-			requestHeader = maskHeaders(HeaderToMap(request.Header), "Request_Header_Masks")
+			requestHeader = maskHeaders(HeaderToMap(request.Header), configuredMasks("Request_Header_Masks"))
 
 			// Mask Response Header
 			var responseHeader map[string]interface{}
-			responseHeader = maskHeaders(HeaderToMap(response.Header), "Response_Header_Masks")
+			responseHeader = maskHeaders(HeaderToMap(response.Header), configuredMasks("Response_Header_Masks"))
 
 			// Send Event To Moesif
-			sendMoesifAsync(request, outgoingReqTime, requestHeader, nil, outgoingReqBody, &reqEncoding, reqContentLength,
+			event := newEvent(request, getClientIp(request), outgoingReqTime, requestHeader, nil, outgoingReqBody, &reqEncoding, reqContentLength,
 				outgoingRspTime, response.StatusCode, responseHeader, outgoingRespBody, &respEncoding, respContentLength,
 				userIdOutgoing, companyIdOutgoing, &sessionTokenOutgoing, metadataOutgoing, &direction)
+			sendMoesifAsync(event, enrichOutgoing(request, response), nil)
 
 		} else {
-			if debug {
-				log.Println("Request Skipped since it is Moesif Event")
-			}
+			logger.Debug("Skipping outgoing event", "url", request.URL.String(), "reason", "moesif_request")
 		}
 	}
 
 	return response, err
 }
 
+// isMoesifRequest reports whether the request is a call to the Moesif API itself
+func isMoesifRequest(request *http.Request) bool {
+	url := request.URL.String()
+	return strings.Contains(url, "moesif.net") ||
+		(moesifapi.Config.BaseURI != "" && strings.HasPrefix(url, moesifapi.Config.BaseURI))
+}
+
 func (t *Transport) transport() http.RoundTripper {
 	if t.Transport != nil {
 		return t.Transport
@@ -3,7 +3,44 @@ package moesifgin
 import (
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers that may carry the client IP, in the order they are checked by default
+var defaultClientIpHeaders = []string{
+	// Standard headers used by Amazon EC2, Heroku, and others.
+	"X-Client-Ip",
+	// Load-balancers (AWS ELB) or proxies.
+	"X-Forwarded-For",
+	// Cloudflare, applied to every request to the origin.
+	// @see https://support.cloudflare.com/hc/en-us/articles/200170986-How-does-Cloudflare-handle-HTTP-Request-headers-
+	"Cf-Connecting-Ip",
+	// Akamai and Cloudflare.
+	"True-Client-Ip",
+	// Default nginx proxy/fcgi; alternative to x-forwarded-for, used by some proxies.
+	"X-Real-Ip",
+	// Rackspace LB and Riverbed's Stingray.
+	"X-Cluster-Client-Ip",
+	"X-Forwarded",
+	"Forwarded-For",
+	// RFC 7239
+	"Forwarded",
+}
+
+// Headers checked by default with trusted proxies. Single-valued headers are left out, as
+// a trusted proxy passes them through unchanged when the client sent them.
+var trustedClientIpHeaders = []string{"Forwarded", "X-Forwarded-For"}
+
+var (
+	// Headers checked for the client IP, see Client_IP_Headers
+	clientIpHeaders = defaultClientIpHeaders
+	// When set, forwarded headers are only honored for requests from these proxies
+	trustedProxies []netip.Prefix
+	// Use gin's own client IP resolution, configured with engine.SetTrustedProxies
+	useGinClientIp bool
 )
 
 func validIp(ipAddress string) bool {
@@ -11,102 +48,174 @@ func validIp(ipAddress string) bool {
 	return ip.To4() != nil || ip.To16() != nil
 }
 
-func getClientIpFromXForwardedFor(ipAddress string) string {
-
-	// Split the string
-	ips := strings.Split(ipAddress, ", ")
-
-	// Sometimes IP addresses in this header can be 'unknown' (http://stackoverflow.com/a/11285650).
-	// Therefore taking the left-most IP address that is not unknown
-	// A Squid configuration directive can also set the value to "unknown" (http://www.squid-cache.org/Doc/config/forwarded_for/)
-	for _, ip := range ips {
-
-		// Azure Web App's also adds a port for some reason, so we'll only use the first part (the IP)
-		if strings.Contains(ip, ":") {
-			ip = strings.Split(ip, ":")[0]
+// clientIpHeadersOption reads the Client_IP_Headers option, the headers to check in order.
+// Trusted proxies must be parsed first, they change the default headers.
+func clientIpHeadersOption(moesifOption map[string]interface{}) []string {
+	headers, found := moesifOption["Client_IP_Headers"].([]string)
+	if !found {
+		if trustedProxies != nil {
+			return trustedClientIpHeaders
 		}
+		return defaultClientIpHeaders
+	}
+	canonical := make([]string, len(headers))
+	for i, header := range headers {
+		canonical[i] = http.CanonicalHeaderKey(header)
+	}
+	return canonical
+}
 
-		// x-forwarded-for may return multiple IP addresses in the format:
-		// "client IP, proxy 1 IP, proxy 2 IP"
-		// Therefore, the right-most IP address is the IP address of the most recent proxy
-		// and the left-most IP address is the IP address of the originating client.
-		// source: http://docs.aws.amazon.com/elasticloadbalancing/latest/classic/x-forwarded-headers.html
-		if validIp(ip) {
-			return ip
+// trustedProxiesOption parses the Trusted_Proxies option, a list of IP addresses and CIDRs
+func trustedProxiesOption(moesifOption map[string]interface{}) []netip.Prefix {
+	proxies, found := moesifOption["Trusted_Proxies"].([]string)
+	if !found {
+		return nil
+	}
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			logger.Error("Ignoring invalid trusted proxy", "proxy", proxy)
 		}
-
 	}
-	// Return empty String
-	return ""
+	return prefixes
 }
 
-func getClientIp(request *http.Request) string {
-
-	// Standard headers used by Amazon EC2, Heroku, and others.
-	if xc, ok := request.Header["X-Client-Ip"]; ok {
-		if validIp(xc[0]) {
-			return xc[0]
+// isTrustedProxy reports whether ip belongs to one of the trusted proxies
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
 		}
 	}
+	return false
+}
 
-	// Load-balancers (AWS ELB) or proxies.
-	if lb, ok := request.Header["X-Forwarded-For"]; ok {
-		xForwardedFor := getClientIpFromXForwardedFor(lb[0])
-		if validIp(xForwardedFor) {
-			return xForwardedFor
+// parseHostIp returns the IP of a node such as "1.2.3.4", "1.2.3.4:80", "::1",
+// "[::1]:80" or a quoted Forwarded node, or "" if it is not an IP address, e.g.
+// "unknown" or an obfuscated identifier like "_hidden"
+func parseHostIp(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	host := node
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return ""
+		}
+		host = node[1:end]
+	} else if !validIp(node) {
+		if h, _, err := net.SplitHostPort(node); err == nil {
+			host = h
 		}
 	}
+	if !validIp(host) {
+		return ""
+	}
+	return host
+}
 
-	// Cloudflare.
-	// @see https://support.cloudflare.com/hc/en-us/articles/200170986-How-does-Cloudflare-handle-HTTP-Request-headers-
-	// CF-Connecting-IP - applied to every request to the origin.
-	if cf, ok := request.Header["Cf-Connecting-Ip"]; ok {
-		if validIp(cf[0]) {
-			return cf[0]
+// forwardedHops returns the for= nodes of RFC 7239 Forwarded header values, from the
+// client to the most recent proxy
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hops = append(hops, node)
+				}
+			}
 		}
 	}
+	return hops
+}
 
-	// Akamai and Cloudflare: True-Client-IP.
-	if tr, ok := request.Header["True-Client-Ip"]; ok {
-		if validIp(tr[0]) {
-			return tr[0]
+// headerHops returns the nodes listed in a client IP header, from the client to the
+// most recent proxy
+func headerHops(header string, values []string) []string {
+	if header == "Forwarded" {
+		return forwardedHops(values)
+	}
+	var hops []string
+	for _, value := range values {
+		for _, node := range strings.Split(value, ",") {
+			// X-Forwarded is sometimes sent in the Forwarded syntax
+			if key, forwarded, found := strings.Cut(strings.TrimSpace(node), "="); found && strings.EqualFold(key, "for") {
+				node = forwarded
+			}
+			hops = append(hops, node)
 		}
 	}
+	return hops
+}
 
-	// Default nginx proxy/fcgi; alternative to x-forwarded-for, used by some proxies.
-	if ngx, ok := request.Header["X-Real-Ip"]; ok {
-		if validIp(ngx[0]) {
-			return ngx[0]
+// clientIpFromHops picks the client IP from a list of nodes. Sometimes IP addresses
+// in these headers are 'unknown' (http://stackoverflow.com/a/11285650), so by default
+// the left-most valid IP is taken. With trusted proxies the hops are walked from
+// right to left instead, returning the first one that is not a trusted proxy, as
+// hops left of it were added by the client and may be spoofed.
+func clientIpFromHops(hops []string) string {
+	if trustedProxies == nil {
+		for _, hop := range hops {
+			if ip := parseHostIp(hop); ip != "" {
+				return ip
+			}
 		}
+		return ""
 	}
-
-	// (Rackspace LB and Riverbed's Stingray)
-	// http://www.rackspace.com/knowledge_center/article/controlling-access-to-linux-cloud-sites-based-on-the-client-ip-address
-	// https://splash.riverbed.com/docs/DOC-1926
-	if rs, ok := request.Header["X-Cluster-Client-Ip"]; ok {
-		if validIp(rs[0]) {
-			return rs[0]
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHostIp(hops[i])
+		if ip == "" {
+			return ""
+		}
+		if !isTrustedProxy(ip) || i == 0 {
+			return ip
 		}
 	}
+	return ""
+}
 
-	if xf, ok := request.Header["X-Forwarded"]; ok {
-		if validIp(xf[0]) {
-			return xf[0]
-		}
+// remoteIp returns the address of the peer of the connection, without its port
+func remoteIp(request *http.Request) string {
+	if ip := parseHostIp(request.RemoteAddr); ip != "" {
+		return ip
 	}
+	return request.RemoteAddr
+}
 
-	if ff, ok := request.Header["Forwarded-For"]; ok {
-		if validIp(ff[0]) {
-			return ff[0]
-		}
+// incomingClientIp resolves the client IP of a request handled by the middleware
+func incomingClientIp(c *gin.Context) string {
+	if useGinClientIp {
+		return c.ClientIP()
 	}
+	return getClientIp(c.Request)
+}
+
+func getClientIp(request *http.Request) string {
+	remote := remoteIp(request)
 
-	if f, ok := request.Header["Forwarded"]; ok {
-		if validIp(f[0]) {
-			return f[0]
+	// Forwarded headers can be set by anyone, only honor them when a trusted proxy set them
+	if trustedProxies != nil && !isTrustedProxy(remote) {
+		return remote
+	}
+
+	for _, header := range clientIpHeaders {
+		if values, ok := request.Header[header]; ok {
+			if ip := clientIpFromHops(headerHops(header, values)); ip != "" {
+				return ip
+			}
 		}
 	}
 
 	// Default Address
-	return request.RemoteAddr
+	return remote
 }
@@ -0,0 +1,41 @@
+package moesifgin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIpWithTrustedProxies(t *testing.T) {
+	options := map[string]interface{}{"Trusted_Proxies": []string{"10.0.0.0/8"}}
+	trustedProxies = trustedProxiesOption(options)
+	clientIpHeaders = clientIpHeadersOption(options)
+	defer func() {
+		trustedProxies = nil
+		clientIpHeaders = defaultClientIpHeaders
+	}()
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer", "203.0.113.9:4000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"spoofed X-Client-Ip", "10.0.0.2:4000", map[string]string{"X-Client-Ip": "1.1.1.1", "X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed True-Client-Ip only", "10.0.0.2:4000", map[string]string{"True-Client-Ip": "1.1.1.1"}, "10.0.0.2"},
+		{"spoofed left-most hop", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"Forwarded", "10.0.0.2:4000", map[string]string{"Forwarded": `for=1.1.1.1, for="[2001:db8::1]:80", for=10.0.0.3`}, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest("GET", "/", nil)
+			request.RemoteAddr = test.remote
+			for header, value := range test.headers {
+				request.Header.Set(header, value)
+			}
+			if ip := getClientIp(request); ip != test.want {
+				t.Errorf("client IP = %q, want %q", ip, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package moesifgin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	moesifapi "github.com/moesif/moesifapi-go"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const collectorTimeout = 10 * time.Second
+
+// Client for the collector, bound to the transport in place before StartCaptureOutgoing
+// replaces http.DefaultTransport so calls to Moesif are never captured themselves
+var collectorClient = &http.Client{Transport: http.DefaultTransport}
+
+// postEvents sends a batch of events to the Moesif collector and waits for the response.
+// Unlike the moesifapi client it reports delivery failures, so callers can retry.
+func postEvents(events []*models.EventModel) error {
+	return postToCollector("/v1/events/batch", events)
+}
+
+// postToCollector gzips body as JSON and posts it to the collector path
+func postToCollector(path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err = gz.Write(payload); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, moesifapi.Config.BaseURI+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Moesif-Application-Id", moesifapi.Config.MoesifApplicationId)
+	req.Header.Set("User-Agent", "moesifgin")
+
+	resp, err := collectorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	appConfig.Notify(resp.Header.Get("X-Moesif-Config-ETag"))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newCollectorError(path, resp)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package moesifgin
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// valueSource is where a declared event field is read from: a request header, or a
+// gin.Context key with an optional dotted path into the maps and structs it holds
+type valueSource struct {
+	header string
+	path   string
+}
+
+var (
+	// Sources of the Identify_User, Identify_Company and Get_Session_Token fields, tried
+	// in order before the callbacks
+	fieldSources = map[string][]valueSource{}
+	// Sources of metadata fields by name
+	metadataSources = map[string]valueSource{}
+)
+
+// parseValueSource parses "header:X-User-Id", "context:auth.user.id" or "auth.user.id"
+func parseValueSource(spec string) valueSource {
+	if name, found := strings.CutPrefix(spec, "header:"); found {
+		return valueSource{header: http.CanonicalHeaderKey(strings.TrimSpace(name))}
+	}
+	return valueSource{path: strings.TrimPrefix(spec, "context:")}
+}
+
+// valueSourcesOption reads the *_From options, each a source or a list of sources
+func valueSourcesOption(moesifOption map[string]interface{}) {
+	fieldSources = map[string][]valueSource{}
+	for option, field := range map[string]string{
+		"Identify_User_From":     "Identify_User",
+		"Identify_Company_From":  "Identify_Company",
+		"Get_Session_Token_From": "Get_Session_Token",
+	} {
+		var specs []string
+		switch value := moesifOption[option].(type) {
+		case string:
+			specs = []string{value}
+		case []string:
+			specs = value
+		}
+		for _, spec := range specs {
+			fieldSources[field] = append(fieldSources[field], parseValueSource(spec))
+		}
+	}
+
+	metadataSources = map[string]valueSource{}
+	if specs, found := moesifOption["Metadata_From"].(map[string]string); found {
+		for name, spec := range specs {
+			metadataSources[name] = parseValueSource(spec)
+		}
+	}
+}
+
+// lookup returns the value of the source for the request
+func (s valueSource) lookup(c *gin.Context) (interface{}, bool) {
+	if s.header != "" {
+		value := c.Request.Header.Get(s.header)
+		return value, value != ""
+	}
+	// Keys may contain dots themselves, so try the longest key first
+	for end := len(s.path); end > 0; end = strings.LastIndex(s.path[:end], ".") {
+		if value, found := c.Get(s.path[:end]); found {
+			if end == len(s.path) {
+				return value, true
+			}
+			return walkPath(value, strings.Split(s.path[end+1:], "."))
+		}
+	}
+	return nil, false
+}
+
+// walkPath follows map keys, struct fields (by name or json tag) and slice indexes
+func walkPath(value interface{}, path []string) (interface{}, bool) {
+	v := reflect.ValueOf(value)
+	for _, name := range path {
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil, false
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		case reflect.Struct:
+			v = structField(v, name)
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= v.Len() {
+				return nil, false
+			}
+			v = v.Index(i)
+		default:
+			return nil, false
+		}
+		if !v.IsValid() {
+			return nil, false
+		}
+	}
+	// A nil pointer at the end of the path is not a value, and may panic when formatted
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil, false
+		}
+	}
+	if !v.CanInterface() {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+// structField returns the exported field matching name or its json tag, ignoring case
+func structField(v reflect.Value, name string) reflect.Value {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name || strings.EqualFold(field.Name, name) {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// declaredString returns the first value found for a field declared with a *_From option
+func declaredString(fieldName string, c *gin.Context) string {
+	for _, source := range fieldSources[fieldName] {
+		if value, found := source.lookup(c); found {
+			if s := stringValue(value); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// declaredMetadata adds the metadata fields declared with Metadata_From
+func declaredMetadata(c *gin.Context, metadata map[string]interface{}) map[string]interface{} {
+	for name, source := range metadataSources {
+		if value, found := source.lookup(c); found {
+			metadata = addMetadata(metadata, name, value)
+		}
+	}
+	return metadata
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
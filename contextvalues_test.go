@@ -0,0 +1,76 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testProfile struct {
+	Name string
+}
+
+type testUser struct {
+	ID      string `json:"id"`
+	Email   string `json:"email,omitempty"`
+	Profile *testProfile
+	Roles   []string
+	secret  string
+}
+
+func TestValueSourceLookup(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.Header.Set("X-User-Id", "header-user")
+	c.Set("user", &testUser{ID: "42", Email: "a@example.com", Roles: []string{"user", "admin"}, secret: "s"})
+	c.Set("claims", map[string]interface{}{"sub": "u1", "org": map[string]interface{}{"id": "o1"}, "empty": nil})
+	c.Set("auth.user", map[string]string{"id": "dotted"})
+	c.Set("ids", map[int]string{1: "one"})
+	c.Set("nilUser", (*testUser)(nil))
+	c.Set("nothing", nil)
+	c.Set("name", "plain")
+
+	tests := []struct {
+		spec  string
+		want  interface{}
+		found bool
+	}{
+		{"header:x-user-id", "header-user", true},
+		{"header:X-Missing", "", false},
+		{"name", "plain", true},
+		{"context:claims.sub", "u1", true},
+		{"claims.org.id", "o1", true},
+		{"claims.missing", nil, false},
+		{"claims.empty", nil, false},
+		{"claims.sub.x", nil, false},
+		{"user.id", "42", true},
+		{"user.email", "a@example.com", true},
+		{"user.ID", "42", true},
+		{"user.roles.1", "admin", true},
+		{"user.roles.2", nil, false},
+		{"user.roles.-1", nil, false},
+		{"user.roles.x", nil, false},
+		{"auth.user.id", "dotted", true},
+		// Nil pointer in the middle and at the end of the path
+		{"user.profile.name", nil, false},
+		{"user.profile", nil, false},
+		{"nilUser.id", nil, false},
+		{"nothing.id", nil, false},
+		{"user.secret", nil, false},
+		{"ids.1", nil, false},
+		{"name.length", nil, false},
+		{"missing.id", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			value, found := parseValueSource(test.spec).lookup(c)
+			if found != test.found || (test.found && value != test.want) {
+				t.Errorf("lookup(%q) = %v, %v, want %v, %v", test.spec, value, found, test.want, test.found)
+			}
+			if !test.found && stringValue(value) != "" {
+				t.Errorf("lookup(%q) = %v, want an empty value", test.spec, value)
+			}
+		})
+	}
+}
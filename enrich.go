@@ -0,0 +1,126 @@
+package moesifgin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// Enricher adds to incoming events before they are queued, or drops them. Enrichers run
+// in the order they are configured, after Get_Metadata and the Identify_* callbacks.
+type Enricher interface {
+	// Enrich may change the metadata, tags, user id, company id or session token of the
+	// event, and returns false to drop it
+	Enrich(c *gin.Context, event *models.EventModel) bool
+}
+
+// EnricherFunc adapts a function to the Enricher interface
+type EnricherFunc func(c *gin.Context, event *models.EventModel) bool
+
+func (f EnricherFunc) Enrich(c *gin.Context, event *models.EventModel) bool {
+	return f(c, event)
+}
+
+// OutgoingEnricher is the Enricher for events captured by the outgoing Transport
+type OutgoingEnricher interface {
+	EnrichOutgoing(request *http.Request, response *http.Response, event *models.EventModel) bool
+}
+
+// OutgoingEnricherFunc adapts a function to the OutgoingEnricher interface
+type OutgoingEnricherFunc func(request *http.Request, response *http.Response, event *models.EventModel) bool
+
+func (f OutgoingEnricherFunc) EnrichOutgoing(request *http.Request, response *http.Response, event *models.EventModel) bool {
+	return f(request, response, event)
+}
+
+var (
+	enrichers         []Enricher
+	outgoingEnrichers []OutgoingEnricher
+)
+
+// enrichersOption reads the Enrichers option, running the GeoIP lookup first if configured
+func enrichersOption(moesifOption map[string]interface{}) []Enricher {
+	var pipeline []Enricher
+	if geoIP != nil {
+		pipeline = append(pipeline, geoIP)
+	}
+	custom, _ := moesifOption["Enrichers"].([]Enricher)
+	for _, enricher := range custom {
+		if enricher != nil {
+			pipeline = append(pipeline, enricher)
+		}
+	}
+	return pipeline
+}
+
+// outgoingEnrichersOption reads the Outgoing_Enrichers option
+func outgoingEnrichersOption(moesifOption map[string]interface{}) []OutgoingEnricher {
+	custom, _ := moesifOption["Outgoing_Enrichers"].([]OutgoingEnricher)
+	var pipeline []OutgoingEnricher
+	for _, enricher := range custom {
+		if enricher != nil {
+			pipeline = append(pipeline, enricher)
+		}
+	}
+	return pipeline
+}
+
+// runEnricher calls an enricher, keeping the event if it panics
+func runEnricher(enricher interface{}, event *models.EventModel, enrich func() bool) (keep bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error("Enricher panicked, keeping the event", "enricher", fmt.Sprintf("%T", enricher), "uri", event.Request.Uri, "error", err)
+			keep = true
+		}
+	}()
+	return enrich()
+}
+
+// enrichIncoming returns the function running the incoming pipeline for a request
+func enrichIncoming(c *gin.Context) func(*models.EventModel) bool {
+	if len(enrichers) == 0 {
+		return nil
+	}
+	return func(event *models.EventModel) bool {
+		for _, enricher := range enrichers {
+			if !runEnricher(enricher, event, func() bool { return enricher.Enrich(c, event) }) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// enrichOutgoing returns the function running the outgoing pipeline for a call
+func enrichOutgoing(request *http.Request, response *http.Response) func(*models.EventModel) bool {
+	if len(outgoingEnrichers) == 0 {
+		return nil
+	}
+	return func(event *models.EventModel) bool {
+		for _, enricher := range outgoingEnrichers {
+			if !runEnricher(enricher, event, func() bool { return enricher.EnrichOutgoing(request, response, event) }) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// SetEventMetadata sets a metadata field of the event. The metadata map is copied, so
+// maps shared with other events or returned by Get_Metadata are not modified.
+func SetEventMetadata(event *models.EventModel, key string, value interface{}) {
+	metadata, _ := event.Metadata.(map[string]interface{})
+	event.Metadata = addMetadata(metadata, key, value)
+}
+
+// AddEventTag appends a tag to the comma separated tags of the event
+func AddEventTag(event *models.EventModel, tag string) {
+	tags := tag
+	if event.Tags != nil && *event.Tags != "" {
+		tags = strings.Join([]string{*event.Tags, tag}, ",")
+	}
+	event.Tags = &tags
+}
@@ -0,0 +1,81 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+func TestEnrichers(t *testing.T) {
+	setSource := func(source string) Enricher {
+		return EnricherFunc(func(c *gin.Context, event *models.EventModel) bool {
+			SetEventMetadata(event, "source", source)
+			AddEventTag(event, source)
+			return true
+		})
+	}
+	// Sees the user set by Identify_User and the metadata set by the enrichers before it
+	recordOrder := EnricherFunc(func(c *gin.Context, event *models.EventModel) bool {
+		metadata, _ := event.Metadata.(map[string]interface{})
+		SetEventMetadata(event, "seen", []interface{}{*event.UserId, metadata["source"]})
+		return true
+	})
+	panicking := EnricherFunc(func(c *gin.Context, event *models.EventModel) bool {
+		panic("enricher bug")
+	})
+	dropping := EnricherFunc(func(c *gin.Context, event *models.EventModel) bool {
+		return false
+	})
+
+	tests := []struct {
+		name      string
+		enrichers []Enricher
+		dropped   bool
+		source    string
+		tags      string
+	}{
+		{"merge order", []Enricher{setSource("first"), recordOrder, setSource("second")}, false, "second", "first,second"},
+		{"panicking enricher", []Enricher{setSource("first"), panicking, setSource("second")}, false, "second", "first,second"},
+		{"nil enricher", []Enricher{nil, setSource("first"), nil}, false, "first", "first"},
+		{"nil function", []Enricher{setSource("first"), EnricherFunc(nil), setSource("second")}, false, "second", "first,second"},
+		{"dropping enricher", []Enricher{setSource("first"), dropping, setSource("second")}, true, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{
+				"Enrichers":     test.enrichers,
+				"Identify_User": func(c *gin.Context) string { return "user-1" },
+				"Get_Metadata": func(c *gin.Context) map[string]interface{} {
+					return map[string]interface{}{"source": "app", "app": "orders"}
+				},
+			})
+			r.GET("/orders", func(c *gin.Context) { c.String(200, "ok") })
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+
+			events := sink.Events()
+			if test.dropped {
+				if len(events) != 0 {
+					t.Errorf("got %d events, want the event dropped", len(events))
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			metadata, _ := events[0].Metadata.(map[string]interface{})
+			if metadata["source"] != test.source || metadata["app"] != "orders" {
+				t.Errorf("metadata = %v, want source %s merged with Get_Metadata", metadata, test.source)
+			}
+			if events[0].Tags == nil || *events[0].Tags != test.tags {
+				t.Errorf("tags = %v, want %s", events[0].Tags, test.tags)
+			}
+			if seen, found := metadata["seen"]; found {
+				if s := seen.([]interface{}); s[0] != "user-1" || s[1] != "first" {
+					t.Errorf("the second enricher saw %v, want the user and the metadata of the first", s)
+				}
+			}
+		})
+	}
+}
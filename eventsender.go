@@ -0,0 +1,231 @@
+package moesifgin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const (
+	defaultSenderQueueSize     = 10000
+	defaultSenderBatchSize     = 200
+	defaultSenderWakeUpSeconds = 2
+)
+
+var (
+	sender *eventSender
+
+	errEventQueueFull = errors.New("moesif event queue is full")
+	errSenderClosed   = errors.New("moesif event sender is closed")
+)
+
+// eventSender batches queued events and sends them to the collector, retrying failed
+// batches and holding them while the circuit breaker is open. Users, companies and
+// subscriptions are sent by the same loop, in the batches they were queued in.
+type eventSender struct {
+	queue     chan *models.EventModel
+	entities  chan entityBatch
+	batchSize int
+	interval  time.Duration
+	dropped   int64
+
+	flushes   chan chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// entityBatch is a batch of users, companies or subscriptions and the collector path it is posted to
+type entityBatch struct {
+	path string
+	body interface{}
+}
+
+func newEventSender(queueSize int, batchSize int, timerWakeupSeconds int) *eventSender {
+	if queueSize <= 0 {
+		queueSize = defaultSenderQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultSenderBatchSize
+	}
+	if timerWakeupSeconds <= 0 {
+		timerWakeupSeconds = defaultSenderWakeUpSeconds
+	}
+	s := &eventSender{
+		queue:     make(chan *models.EventModel, queueSize),
+		entities:  make(chan entityBatch, queueSize),
+		batchSize: batchSize,
+		interval:  time.Duration(timerWakeupSeconds) * time.Second,
+		flushes:   make(chan chan struct{}),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// QueueEvent adds the event to the queue, dropping it if the queue is full
+func (s *eventSender) QueueEvent(event *models.EventModel) error {
+	if s.closed() {
+		return errSenderClosed
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return errEventQueueFull
+	}
+}
+
+// queueEntities adds a batch of users, companies or subscriptions to the queue
+func (s *eventSender) queueEntities(path string, body interface{}) error {
+	if s.closed() {
+		return errSenderClosed
+	}
+	select {
+	case s.entities <- entityBatch{path: path, body: body}:
+		return nil
+	default:
+		return errEventQueueFull
+	}
+}
+
+func (s *eventSender) droppedEvents() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+func (s *eventSender) loop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	batch := make([]*models.EventModel, 0, s.batchSize)
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case entities := <-s.entities:
+			s.sendEntities(entities)
+			continue
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-s.flushes:
+			s.drain(batch)
+			batch = make([]*models.EventModel, 0, s.batchSize)
+			close(done)
+			continue
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+		s.send(batch)
+		batch = make([]*models.EventModel, 0, s.batchSize)
+	}
+}
+
+// drain sends the pending batch and everything queued so far
+func (s *eventSender) drain(batch []*models.EventModel) {
+	for {
+		select {
+		case event := <-s.queue:
+			batch = append(batch, event)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case entities := <-s.entities:
+			s.sendEntities(entities)
+			continue
+		default:
+			if len(batch) > 0 {
+				s.send(batch)
+			}
+			return
+		}
+		s.send(batch)
+		batch = make([]*models.EventModel, 0, s.batchSize)
+	}
+}
+
+// flush sends the events queued so far, returning once they were sent or ctx is done
+func (s *eventSender) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case s.flushes <- done:
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close sends the events queued so far and stops the loop. Events queued afterwards are rejected.
+func (s *eventSender) close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.stopped
+}
+
+func (s *eventSender) closed() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// send delivers a batch of events. Batches that fail after all retries are dropped.
+func (s *eventSender) send(batch []*models.EventModel) {
+	if err := s.deliver(func() error { return sendEventsBatch(batch) }); err != nil {
+		atomic.AddInt64(&s.dropped, int64(len(batch)))
+		logger.Error("Dropping events after failing to send them to Moesif", "events", len(batch), "error", err)
+	}
+}
+
+// sendEntities delivers a batch of users, companies or subscriptions
+func (s *eventSender) sendEntities(entities entityBatch) {
+	err := s.deliver(func() error {
+		return withRetry(func() error { return postToCollector(entities.path, entities.body) })
+	})
+	if err != nil {
+		logger.Error("Dropping batch after failing to send it to Moesif", "path", entities.path, "error", err)
+	}
+}
+
+// deliver calls send, waiting out open circuit breaker periods unless the sender is closing
+func (s *eventSender) deliver(send func() error) error {
+	for {
+		err := send()
+		if !errors.Is(err, errCircuitOpen) {
+			return err
+		}
+		wait := breaker.wait()
+		if wait < retryMinBackoff {
+			wait = retryMinBackoff
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return err
+		}
+	}
+}
+
+// sendEventsBatch posts a batch of events to the collector with retries
+func sendEventsBatch(events []*models.EventModel) error {
+	return withRetry(func() error { return postEvents(events) })
+}
@@ -0,0 +1,136 @@
+package moesifgin
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	moesifapi "github.com/moesif/moesifapi-go"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// newTestCollector starts a collector counting the records posted to each path
+func newTestCollector(t *testing.T) (counts func(path string) int) {
+	t.Helper()
+	var mu sync.Mutex
+	received := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var records []json.RawMessage
+		if err := json.NewDecoder(gz).Decode(&records); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received[r.URL.Path] += len(records)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	baseURI := moesifapi.Config.BaseURI
+	moesifapi.Config.BaseURI = server.URL
+	t.Cleanup(func() { moesifapi.Config.BaseURI = baseURI })
+
+	return func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[path]
+	}
+}
+
+func TestEventSenderFlushAndClose(t *testing.T) {
+	counts := newTestCollector(t)
+	// A long interval, so only flush and close send
+	s := newEventSender(100, 50, 3600)
+
+	for i := 0; i < 3; i++ {
+		s.QueueEvent(&models.EventModel{})
+	}
+	s.queueEntities("/v1/users/batch", []*models.UserModel{{UserId: "user-1"}, {UserId: "user-2"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := counts("/v1/events/batch"); n != 3 {
+		t.Errorf("sent %d events after flush, want 3", n)
+	}
+	if n := counts("/v1/users/batch"); n != 2 {
+		t.Errorf("sent %d users after flush, want 2", n)
+	}
+
+	s.QueueEvent(&models.EventModel{})
+	s.close()
+	if n := counts("/v1/events/batch"); n != 4 {
+		t.Errorf("sent %d events after close, want 4", n)
+	}
+	if err := s.QueueEvent(&models.EventModel{}); err != errSenderClosed {
+		t.Errorf("QueueEvent after close returned %v, want %v", err, errSenderClosed)
+	}
+}
+
+func TestSpoolFlushSealsOpenSegment(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	s, err := openSpool(t.TempDir(), func(events []*models.EventModel) error {
+		mu.Lock()
+		sent += len(events)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Segments are only sealed by age after an hour
+	s.maxSegmentAge = time.Hour
+	s.start()
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		if err := s.Append(&models.EventModel{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 3 {
+		t.Errorf("sent %d events, want 3", sent)
+	}
+}
+
+func TestSpoolCloseKeepsUnsentSegments(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, func([]*models.EventModel) error { return errCircuitOpen })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(&models.EventModel{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := s.Append(&models.EventModel{}); err != errSpoolClosed {
+		t.Errorf("Append after close returned %v, want %v", err, errSpoolClosed)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt)); len(segments) != 1 {
+		t.Errorf("got %d sealed segments, want 1", len(segments))
+	}
+	if open, _ := filepath.Glob(filepath.Join(dir, "*"+spoolOpenExt)); len(open) != 0 {
+		t.Errorf("open segment left after close: %v", open)
+	}
+}
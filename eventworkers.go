@@ -0,0 +1,259 @@
+package moesifgin
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const (
+	defaultEventWorkers                 = 2
+	defaultEventWorkerQueueSize         = 1000
+	defaultEventWorkerBlockTimeoutMilli = 100
+
+	// Dropped events are logged at most once per interval, they are counted by eventsOverflowed
+	eventDropWarningInterval = 10 * time.Second
+)
+
+// Overflow policies of the worker pool, for when its queue is full
+const (
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+	overflowBlock      = "block"
+)
+
+var eventWorkers *eventWorkerPool
+
+// dropWarning counts the events dropped since the last warning
+var dropWarning struct {
+	mu      sync.Mutex
+	dropped int
+	last    time.Time
+}
+
+// capturedEvent is what the middleware captured of a request and its response, owned by
+// the worker building the event once it is submitted
+type capturedEvent struct {
+	request  *http.Request
+	clientIp string
+	reqTime  time.Time
+	rspTime  time.Time
+	status   int
+
+	apiVersion   *string
+	userId       string
+	companyId    string
+	sessionToken string
+	metadata     map[string]interface{}
+
+	// Either the buffered request body, read by the worker, or the bytes read already
+	reqBodyReader     io.Reader
+	reqBody           []byte
+	respBody          []byte
+	respContentLength *int64
+	captureBody       bool
+
+	reqHeader       map[string]interface{}
+	respHeader      map[string]interface{}
+	reqHeaderMasks  []string
+	respHeaderMasks []string
+	reqBodyMasks    []string
+	respBodyMasks   []string
+
+	enrich    func(*models.EventModel) bool
+	sampling  *samplingDecision
+	wsSession *webSocketSession
+}
+
+// build parses and masks the captured bodies and headers, then queues the event
+func (e *capturedEvent) build() {
+	if e.reqBodyReader != nil {
+		readReqBody, err := ioutil.ReadAll(e.reqBodyReader)
+		if err != nil {
+			logger.Debug("Could not read request body", "error", err)
+		}
+		e.reqBody = readReqBody
+	}
+	reqContentLength := getContentLength(e.request.Header, e.reqBody)
+
+	// Parse the bodies if they are not empty
+	var reqBody, respBody interface{}
+	var reqEncoding, respEncoding string
+	if e.captureBody && len(e.reqBody) > 0 {
+		reqBody, reqEncoding = parseBody(e.reqBody, e.reqBodyMasks)
+	}
+	if e.captureBody && len(e.respBody) > 0 {
+		respBody, respEncoding = parseBody(e.respBody, e.respBodyMasks)
+	}
+
+	// Mask Headers
+	requestHeader := maskHeaders(e.reqHeader, e.reqHeaderMasks)
+	responseHeader := maskHeaders(e.respHeader, e.respHeaderMasks)
+
+	direction := "Incoming"
+	event := newEvent(e.request, e.clientIp, e.reqTime, requestHeader, e.apiVersion, reqBody, &reqEncoding, reqContentLength,
+		e.rspTime, e.status, responseHeader, respBody, &respEncoding, e.respContentLength,
+		e.userId, e.companyId, &e.sessionToken, e.metadata, &direction)
+	if !enrichEvent(event, e.enrich) {
+		if e.wsSession != nil {
+			e.wsSession.skip()
+		}
+		return
+	}
+
+	// The WebSocket session summary is sent once the connection closes
+	if e.wsSession != nil {
+		e.wsSession.identify(e, event)
+	}
+	sendMoesifAsync(event, nil, e.sampling)
+}
+
+// drop discards an event the worker pool has no room for
+func (e *capturedEvent) drop() {
+	atomic.AddInt64(&metrics.eventsOverflowed, 1)
+	warnDropped()
+	if e.wsSession != nil {
+		e.wsSession.skip()
+	}
+}
+
+// warnDropped logs a warning with the number of events dropped, at most once per interval
+func warnDropped() {
+	dropWarning.mu.Lock()
+	defer dropWarning.mu.Unlock()
+	dropWarning.dropped++
+	if time.Since(dropWarning.last) < eventDropWarningInterval {
+		return
+	}
+	logger.Warn("Dropping events, the event worker queue is full", "dropped", dropWarning.dropped)
+	dropWarning.dropped = 0
+	dropWarning.last = time.Now()
+}
+
+// eventWorkerPool builds events off the request goroutines, so parsing, masking and
+// encoding bodies do not add to the latency of responses
+type eventWorkerPool struct {
+	queue        chan *capturedEvent
+	overflow     string
+	blockTimeout time.Duration
+	workers      sync.WaitGroup
+}
+
+// eventWorkersOption reads the Event_Worker* options, returning nil to build events on
+// the request goroutine
+func eventWorkersOption(moesifOption map[string]interface{}) *eventWorkerPool {
+	workers := defaultEventWorkers
+	if n, found := moesifOption["Event_Workers"].(int); found {
+		workers = n
+	}
+	if workers <= 0 {
+		return nil
+	}
+	queueSize := defaultEventWorkerQueueSize
+	if size, found := moesifOption["Event_Worker_Queue_Size"].(int); found && size > 0 {
+		queueSize = size
+	}
+	overflow := overflowDropNewest
+	if policy, found := moesifOption["Event_Worker_Overflow"].(string); found {
+		switch policy {
+		case overflowDropNewest, overflowDropOldest, overflowBlock:
+			overflow = policy
+		default:
+			logger.Error("Ignoring invalid Event_Worker_Overflow", "policy", policy)
+		}
+	}
+	blockTimeout := defaultEventWorkerBlockTimeoutMilli * time.Millisecond
+	if timeout, found := moesifOption["Event_Worker_Block_Timeout_Ms"].(int); found && timeout > 0 {
+		blockTimeout = time.Duration(timeout) * time.Millisecond
+	}
+	return newEventWorkerPool(workers, queueSize, overflow, blockTimeout)
+}
+
+func newEventWorkerPool(workers int, queueSize int, overflow string, blockTimeout time.Duration) *eventWorkerPool {
+	p := &eventWorkerPool{
+		queue:        make(chan *capturedEvent, queueSize),
+		overflow:     overflow,
+		blockTimeout: blockTimeout,
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *eventWorkerPool) work() {
+	defer p.workers.Done()
+	for captured := range p.queue {
+		p.build(captured)
+	}
+}
+
+// close builds the events queued so far and stops the workers. Nothing may be submitted afterwards.
+func (p *eventWorkerPool) close() {
+	close(p.queue)
+	p.workers.Wait()
+}
+
+// build builds an event, recovering from panics in callbacks such as enrichers so the
+// worker keeps running
+func (p *eventWorkerPool) build(captured *capturedEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error("Could not build event", "uri", captured.request.URL.Path, "error", err)
+			if captured.wsSession != nil {
+				captured.wsSession.skip()
+			}
+		}
+	}()
+	captured.build()
+}
+
+// submit queues a captured event, applying the overflow policy when the queue is full
+func (p *eventWorkerPool) submit(captured *capturedEvent) {
+	select {
+	case p.queue <- captured:
+		return
+	default:
+	}
+
+	switch p.overflow {
+	case overflowDropOldest:
+		for {
+			select {
+			case p.queue <- captured:
+				return
+			default:
+			}
+			// Make room, unless a worker just did
+			select {
+			case oldest := <-p.queue:
+				oldest.drop()
+			default:
+			}
+		}
+	case overflowBlock:
+		timer := time.NewTimer(p.blockTimeout)
+		defer timer.Stop()
+		select {
+		case p.queue <- captured:
+		case <-timer.C:
+			captured.drop()
+		}
+	default:
+		captured.drop()
+	}
+}
+
+// workerQueueDepth returns the number of captured events waiting for a worker
+func workerQueueDepth() int {
+	if eventWorkers == nil {
+		return 0
+	}
+	return len(eventWorkers.queue)
+}
@@ -0,0 +1,43 @@
+package moesifgin
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDroppedEventsAreLoggedOncePerInterval(t *testing.T) {
+	var logs bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	defer func() { logger = previous }()
+	dropWarning.mu.Lock()
+	dropWarning.dropped, dropWarning.last = 0, time.Time{}
+	dropWarning.mu.Unlock()
+
+	// Neither worker runs, so the queue stays full
+	p := &eventWorkerPool{queue: make(chan *capturedEvent, 1), overflow: overflowDropNewest}
+	overflowed := atomic.LoadInt64(&metrics.eventsOverflowed)
+	for i := 0; i < 101; i++ {
+		p.submit(&capturedEvent{request: httptest.NewRequest("GET", "/orders", nil)})
+	}
+	if n := atomic.LoadInt64(&metrics.eventsOverflowed) - overflowed; n != 100 {
+		t.Errorf("overflowed %d events, want 100", n)
+	}
+	if n := strings.Count(logs.String(), "Dropping events"); n != 1 {
+		t.Errorf("logged %d warnings, want 1:\n%s", n, logs.String())
+	}
+
+	// Once the interval passed, the next drop reports those dropped in between
+	dropWarning.mu.Lock()
+	dropWarning.last = time.Now().Add(-eventDropWarningInterval)
+	dropWarning.mu.Unlock()
+	p.submit(&capturedEvent{request: httptest.NewRequest("GET", "/orders", nil)})
+	if !strings.Contains(logs.String(), "dropped=100") {
+		t.Errorf("warning does not report the dropped events:\n%s", logs.String())
+	}
+}
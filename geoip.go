@@ -0,0 +1,178 @@
+package moesifgin
+
+import (
+	"maps"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const (
+	defaultGeoIPCacheSize     = 4096
+	defaultGeoIPReloadSeconds = 60
+)
+
+var geoIP *geoIPLookup
+
+// geoIPLookup adds the country, region, ASN and hosting flag of the client IP to events,
+// from local MaxMind DB files such as GeoLite2-City and GeoLite2-ASN
+type geoIPLookup struct {
+	databases []*geoIPDatabase
+	cache     *lruCache
+	stop      chan struct{}
+}
+
+// geoIPDatabase is a MaxMind DB file, reopened when it changes on disk
+type geoIPDatabase struct {
+	path    string
+	reader  atomic.Pointer[mmdbReader]
+	modTime time.Time
+	size    int64
+}
+
+func newGeoIPLookup(paths []string, cacheSize int) (*geoIPLookup, error) {
+	g := &geoIPLookup{cache: newLRUCache(cacheSize), stop: make(chan struct{})}
+	for _, path := range paths {
+		db := &geoIPDatabase{path: path}
+		if _, err := db.reload(); err != nil {
+			return nil, err
+		}
+		g.databases = append(g.databases, db)
+	}
+	return g, nil
+}
+
+// reload reopens the database if its file changed, reporting whether it did
+func (db *geoIPDatabase) reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(db.modTime) && info.Size() == db.size {
+		return false, nil
+	}
+	reader, err := openMMDB(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.reader.Store(reader)
+	db.modTime, db.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// reloadLoop checks the database files for changes every interval
+func (g *geoIPLookup) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.stop:
+			return
+		}
+		changed := false
+		for _, db := range g.databases {
+			reloaded, err := db.reload()
+			if err != nil {
+				// Keep using the database that is already loaded, the file may be mid-update
+				logger.Warn("Could not reload GeoIP database", "path", db.path, "error", err)
+			}
+			changed = changed || reloaded
+		}
+		if changed {
+			logger.Debug("Reloaded GeoIP databases")
+			g.cache.purge()
+		}
+	}
+}
+
+// Enrich adds the fields found for the client IP of the event under moesif_geo
+func (g *geoIPLookup) Enrich(c *gin.Context, event *models.EventModel) bool {
+	if event.Request.IpAddress != nil {
+		if fields := g.lookup(*event.Request.IpAddress); fields != nil {
+			// The fields are cached, so events get their own copy to modify
+			SetEventMetadata(event, "moesif_geo", maps.Clone(fields))
+		}
+	}
+	return true
+}
+
+// lookup returns the location and network fields of ip, or nil if none are known
+func (g *geoIPLookup) lookup(ip string) map[string]interface{} {
+	if cached, found := g.cache.get(ip); found {
+		fields, _ := cached.(map[string]interface{})
+		return fields
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]interface{})
+	for _, db := range g.databases {
+		record, err := db.reader.Load().lookup(addr)
+		if err != nil {
+			logger.Warn("GeoIP lookup failed", "path", db.path, "error", err)
+			continue
+		}
+		if record, ok := record.(map[string]interface{}); ok {
+			geoIPFields(record, fields)
+		}
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	g.cache.add(ip, fields)
+	return fields
+}
+
+// geoIPFields copies the fields of interest from a City, Country, ASN, Anonymous IP or
+// Insights record
+func geoIPFields(record map[string]interface{}, fields map[string]interface{}) {
+	if country := mmdbPath(record, "country", "iso_code"); country != nil {
+		fields["country"] = country
+	} else if country := mmdbPath(record, "registered_country", "iso_code"); country != nil {
+		fields["country"] = country
+	}
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if region := mmdbPath(subdivisions[0], "iso_code"); region != nil {
+			fields["region"] = region
+		}
+		if name := mmdbPath(subdivisions[0], "names", "en"); name != nil {
+			fields["region_name"] = name
+		}
+	}
+	if city := mmdbPath(record, "city", "names", "en"); city != nil {
+		fields["city"] = city
+	}
+
+	for _, traits := range []interface{}{record, record["traits"]} {
+		if asn := mmdbPath(traits, "autonomous_system_number"); asn != nil {
+			fields["asn"] = asn
+		}
+		if org := mmdbPath(traits, "autonomous_system_organization"); org != nil {
+			fields["as_organization"] = org
+		}
+		if hosting, ok := mmdbPath(traits, "is_hosting_provider").(bool); ok && hosting {
+			fields["hosting"] = true
+		}
+		if userType := mmdbPath(traits, "user_type"); userType == "hosting" {
+			fields["hosting"] = true
+		}
+	}
+}
+
+// mmdbPath returns the value at the path of map keys in a decoded record, or nil
+func mmdbPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
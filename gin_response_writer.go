@@ -3,9 +3,13 @@ package moesifgin
 import (
 	"bufio"
 	"bytes"
-	"log"
+	"context"
+	"errors"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,6 +17,18 @@ import (
 const (
 	noWritten     = -1
 	defaultStatus = http.StatusOK
+
+	// Default limits for capturing streamed (SSE and chunked) response bodies
+	defaultStreamCaptureMaxBytes  = 16 * 1024
+	defaultStreamCaptureMaxEvents = 10
+
+	abortedByContextKey = "moesif.abortedBy"
+)
+
+var (
+	streamCaptureMaxBytes  = defaultStreamCaptureMaxBytes
+	streamCaptureMaxEvents = defaultStreamCaptureMaxEvents
+	sseEventDelimiter      = []byte("\n\n")
 )
 
 // This wraps the gin.ResponseWriter to capture the response body for logging
@@ -21,6 +37,32 @@ type logGinResponseWriter struct {
 	body   *bytes.Buffer
 	size   int
 	status int
+
+	// Streaming capture state. Once a response is detected as a stream only the
+	// first streamCaptureMaxEvents events or streamCaptureMaxBytes bytes are kept.
+	streaming    bool
+	sse          bool
+	captureDone  bool
+	streamEvents int
+	streamStart  time.Time
+	totalBytes   int64
+
+	// Whether the response body is not captured because the request was sampled out
+	discardBody bool
+
+	// Latency breakdown of the request, nil outside of the middleware
+	timing *requestTiming
+
+	// The request context, used to tell whether the request was aborted
+	ctx *gin.Context
+
+	// Whether and when the client went away while the handlers ran
+	cancel     *cancelWatch
+	writeErr   error
+	writeErrAt time.Time
+
+	// Called with the hijacked connection, e.g. to observe WebSocket traffic
+	hijackHook func(net.Conn, *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter)
 }
 
 var _ gin.ResponseWriter = (*logGinResponseWriter)(nil) // Ensure that it implements the interface completely
@@ -37,7 +79,7 @@ func NewLogGinResponseWriter(w gin.ResponseWriter) *logGinResponseWriter {
 func (w *logGinResponseWriter) WriteHeader(code int) {
 	if w.status != code {
 		if w.Written() {
-			log.Printf("[WARNING] Headers were already written. Wanted to override status code %d with %d", w.status, code)
+			logger.Warn("Headers were already written, ignoring status code", "status", w.status, "ignored_status", code)
 			return
 		}
 		w.status = code
@@ -46,21 +88,179 @@ func (w *logGinResponseWriter) WriteHeader(code int) {
 }
 
 func (w *logGinResponseWriter) Write(data []byte) (int, error) {
-	w.WriteHeaderNow()           // Ensure header is written if it's not already
-	n, err := w.body.Write(data) // Write to the buffer first
-	if err != nil {
-		return n, err
+	w.WriteHeaderNow() // Ensure header is written if it's not already
+	w.capture(data)    // Write to the buffer first
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	if err != nil && w.writeErr == nil {
+		// The client most likely went away
+		w.writeErr = err
+		w.writeErrAt = time.Now()
 	}
-	return w.ResponseWriter.Write(data) // Write to the underlying ResponseWriter
+	return n, err
 }
 
 func (w *logGinResponseWriter) WriteString(s string) (int, error) {
-	w.WriteHeaderNow()
-	n, err := w.body.WriteString(s) // Write string to the buffer
-	if err != nil {
-		return n, err
+	return w.Write([]byte(s))
+}
+
+// SetAbortedBy records name as the handler aborting the request, e.g. before
+// c.AbortWithStatus(401) in an authentication middleware, reported as aborted_by. It is
+// opt-in: gin does not record which handler aborted a request, so aborted_by is only
+// reported for handlers calling SetAbortedBy.
+func SetAbortedBy(c *gin.Context, name string) {
+	c.Set(abortedByContextKey, name)
+}
+
+// abortedBy returns the handler that aborted the request, as set with SetAbortedBy
+func (w *logGinResponseWriter) abortedBy() string {
+	value, _ := w.ctx.Get(abortedByContextKey)
+	name, _ := value.(string)
+	return name
+}
+
+// responseMetadata describes how much of the response reached the client, for the
+// event metadata
+func (w *logGinResponseWriter) responseMetadata() map[string]interface{} {
+	written := w.size
+	if written < 0 {
+		written = 0
+	}
+	response := map[string]interface{}{
+		"bytes_written":  written,
+		"bytes_captured": w.body.Len(),
+	}
+	if w.ctx != nil && w.ctx.IsAborted() {
+		response["aborted"] = true
+		if name := w.abortedBy(); name != "" {
+			response["aborted_by"] = name
+		}
+	}
+	w.addCancellation(response)
+	return response
+}
+
+// addCancellation marks the response as aborted by the client, or as timed out if the
+// request context hit its deadline, with the time elapsed until then
+func (w *logGinResponseWriter) addCancellation(response map[string]interface{}) {
+	var at time.Time
+	var err error
+	if w.cancel != nil {
+		at, err = w.cancel.result()
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		response["timed_out"] = true
+	case err != nil:
+		response["client_aborted"] = true
+	case w.writeErr != nil:
+		response["client_aborted"] = true
+		at = w.writeErrAt
+	default:
+		return
+	}
+	if w.writeErr != nil {
+		response["write_error"] = w.writeErr.Error()
+	}
+	if w.timing != nil {
+		response["canceled_after_ms"] = millis(at.Sub(w.timing.start))
+	}
+}
+
+// capture copies written data into the body buffer, bounding the amount kept for streams
+func (w *logGinResponseWriter) capture(data []byte) {
+	w.totalBytes += int64(len(data))
+	if w.discardBody {
+		return
+	}
+	if !w.streaming {
+		w.body.Write(data)
+		atomic.AddInt64(&metrics.bodyBytesBuffered, int64(len(data)))
+		return
+	}
+
+	eventsBefore := w.streamEvents
+	if w.sse {
+		w.streamEvents += bytes.Count(data, sseEventDelimiter)
+	}
+	if w.captureDone {
+		return
+	}
+	// Only data after the last event kept is cut, so a stream ending at the limit is complete
+	if w.sse && streamCaptureMaxEvents > 0 && w.streamEvents >= streamCaptureMaxEvents {
+		if end := endOfEvent(data, streamCaptureMaxEvents-eventsBefore); end < len(data) {
+			data = data[:end]
+			w.captureDone = true
+		}
+	}
+	if room := streamCaptureMaxBytes - w.body.Len(); len(data) > room {
+		data = data[:room]
+		w.captureDone = true
+	}
+	w.body.Write(data)
+	atomic.AddInt64(&metrics.bodyBytesBuffered, int64(len(data)))
+}
+
+// endOfEvent returns the offset just past the n-th SSE event delimiter in data
+func endOfEvent(data []byte, n int) int {
+	end := 0
+	for ; n > 0; n-- {
+		i := bytes.Index(data[end:], sseEventDelimiter)
+		if i < 0 {
+			return len(data)
+		}
+		end += i + len(sseEventDelimiter)
+	}
+	return end
+}
+
+// detectStreaming marks the response as a stream if it is an event stream or chunked,
+// or if it is being flushed before a Content-Length is known
+func (w *logGinResponseWriter) detectStreaming(flushing bool) {
+	if w.streaming {
+		return
+	}
+	header := w.Header()
+	w.sse = strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+	chunked := strings.Contains(strings.ToLower(header.Get("Transfer-Encoding")), "chunked")
+	if !w.sse && !chunked && !(flushing && header.Get("Content-Length") == "") {
+		return
+	}
+	w.streaming = true
+	w.streamStart = time.Now().UTC()
+
+	// Apply the stream limits to anything buffered before the stream was detected
+	if w.sse {
+		w.streamEvents = bytes.Count(w.body.Bytes(), sseEventDelimiter)
+		if streamCaptureMaxEvents > 0 && w.streamEvents >= streamCaptureMaxEvents {
+			if end := endOfEvent(w.body.Bytes(), streamCaptureMaxEvents); end < w.body.Len() {
+				w.body.Truncate(end)
+				w.captureDone = true
+			}
+		}
+	}
+	if w.body.Len() > streamCaptureMaxBytes {
+		w.body.Truncate(streamCaptureMaxBytes)
+		w.captureDone = true
+	}
+}
+
+// streamMetadata describes a streamed response for the event metadata, or nil if the
+// response was not streamed
+func (w *logGinResponseWriter) streamMetadata(rspTime time.Time) map[string]interface{} {
+	if !w.streaming {
+		return nil
+	}
+	stream := map[string]interface{}{
+		"duration_ms":    rspTime.Sub(w.streamStart).Milliseconds(),
+		"total_bytes":    w.totalBytes,
+		"captured_bytes": w.body.Len(),
+		"truncated":      w.captureDone,
+	}
+	if w.sse {
+		stream["events"] = w.streamEvents
 	}
-	return w.ResponseWriter.Write([]byte(s)) // Convert string to bytes and write
+	return stream
 }
 
 func (w *logGinResponseWriter) Body() *bytes.Buffer {
@@ -68,11 +268,9 @@ func (w *logGinResponseWriter) Body() *bytes.Buffer {
 }
 
 func (w *logGinResponseWriter) Flush() {
+	w.detectStreaming(true)
 	w.WriteHeaderNow()
 	w.ResponseWriter.(http.Flusher).Flush()
-	if w.body.Len() > 0 {
-		log.Printf("Buffered response body: %s", w.body.String()) // Log or process the buffered response body
-	}
 }
 
 func (w *logGinResponseWriter) Unwrap() http.ResponseWriter {
@@ -81,6 +279,10 @@ func (w *logGinResponseWriter) Unwrap() http.ResponseWriter {
 
 func (w *logGinResponseWriter) WriteHeaderNow() {
 	if !w.Written() {
+		w.detectStreaming(false)
+		if w.timing != nil {
+			w.timing.writingHeader(w.Header())
+		}
 		w.size = 0
 		w.ResponseWriter.WriteHeader(w.status)
 	}
@@ -103,7 +305,11 @@ func (w *logGinResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if w.size < 0 {
 		w.size = 0
 	}
-	return w.ResponseWriter.(http.Hijacker).Hijack()
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && w.hijackHook != nil {
+		conn, rw = w.hijackHook(conn, rw)
+	}
+	return conn, rw, err
 }
 
 // CloseNotify implements the http.CloseNotifier interface.
@@ -0,0 +1,122 @@
+package moesifgin
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamCaptureLimitsIgnoreInvalidValues(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{
+		"Stream_Capture_Max_Bytes":  -1,
+		"Stream_Capture_Max_Events": -1,
+	})
+	if streamCaptureMaxBytes != defaultStreamCaptureMaxBytes || streamCaptureMaxEvents != defaultStreamCaptureMaxEvents {
+		t.Fatalf("limits = %d bytes, %d events, want the defaults", streamCaptureMaxBytes, streamCaptureMaxEvents)
+	}
+	r.GET("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(c.Writer, "data: %d\n\n", i)
+			c.Writer.Flush()
+		}
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil))
+	if events := sink.Events(); len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+}
+
+func TestAbortedBy(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{})
+	auth := func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			SetAbortedBy(c, "auth")
+			c.AbortWithStatusJSON(401, gin.H{"error": "unauthorized"})
+		}
+	}
+	// Without SetAbortedBy the request is only reported as aborted
+	quota := func(c *gin.Context) { c.AbortWithStatus(429) }
+	r.GET("/orders", auth, func(c *gin.Context) { c.String(200, "ok") })
+	r.GET("/reports", quota, func(c *gin.Context) { c.String(200, "ok") })
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/reports", nil))
+	events := sink.Events()
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	response, _ := events[0].Metadata.(map[string]interface{})["moesif_response"].(map[string]interface{})
+	if response["aborted"] != true || response["aborted_by"] != "auth" {
+		t.Errorf("moesif_response = %v, want aborted by auth", response)
+	}
+	response, _ = events[1].Metadata.(map[string]interface{})["moesif_response"].(map[string]interface{})
+	if _, found := response["aborted_by"]; response["aborted"] != true || found {
+		t.Errorf("moesif_response = %v, want aborted without aborted_by", response)
+	}
+}
+
+func TestStreamCaptureLimits(t *testing.T) {
+	sse := func(events int) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Header("Content-Type", "text/event-stream")
+			for i := 0; i < events; i++ {
+				fmt.Fprintf(c.Writer, "data: %02d\n\n", i) // 10 bytes
+				c.Writer.Flush()
+			}
+		}
+	}
+	chunked := func(chunks int) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Header("Content-Type", "application/octet-stream")
+			for i := 0; i < chunks; i++ {
+				c.Writer.Write([]byte(strings.Repeat("x", 100)))
+				c.Writer.Flush()
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		maxBytes  int
+		maxEvents int
+		handler   gin.HandlerFunc
+		total     int64
+		captured  int
+		events    int // -1 for streams without events
+		truncated bool
+	}{
+		{"SSE over the event limit", 1000, 3, sse(20), 200, 30, 20, true},
+		{"SSE over the byte limit", 25, 10, sse(5), 50, 25, 5, true},
+		{"SSE at the event limit", 1000, 3, sse(3), 30, 30, 3, false},
+		{"SSE within the limits", 1000, 10, sse(5), 50, 50, 5, false},
+		{"chunked over the byte limit", 256, 10, chunked(10), 1000, 256, -1, true},
+		{"chunked at the byte limit", 300, 10, chunked(3), 300, 300, -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{
+				"Stream_Capture_Max_Bytes":  test.maxBytes,
+				"Stream_Capture_Max_Events": test.maxEvents,
+			})
+			r.GET("/stream", test.handler)
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil))
+
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			stream, _ := events[0].Metadata.(map[string]interface{})["moesif_stream"].(map[string]interface{})
+			if stream["total_bytes"] != test.total || stream["captured_bytes"] != test.captured || stream["truncated"] != test.truncated {
+				t.Errorf("moesif_stream = %v, want %d bytes with %d captured, truncated %v", stream, test.total, test.captured, test.truncated)
+			}
+			if count, found := stream["events"]; (test.events < 0 && found) || (test.events >= 0 && count != test.events) {
+				t.Errorf("moesif_stream events = %v, want %d", count, test.events)
+			}
+		})
+	}
+}
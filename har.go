@@ -0,0 +1,386 @@
+package moesifgin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const defaultHARMaxEntries = 1000
+
+// HAR is an HTTP Archive 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// EventsToHAR converts captured events into a HAR log. Bodies and headers are exported
+// as captured, so any masking applied by the middleware is preserved.
+func EventsToHAR(events []*models.EventModel) *HAR {
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "moesifgin", Version: "1.0"},
+		Entries: make([]HAREntry, 0, len(events)),
+	}}
+	for _, event := range events {
+		if event != nil {
+			har.Log.Entries = append(har.Log.Entries, eventToHAREntry(event))
+		}
+	}
+	return har
+}
+
+func eventToHAREntry(event *models.EventModel) HAREntry {
+	var entry HAREntry
+	request, response := event.Request, event.Response
+
+	var elapsed time.Duration
+	if request.Time != nil {
+		entry.StartedDateTime = request.Time.Format(time.RFC3339Nano)
+		if response.Time != nil {
+			elapsed = response.Time.Sub(*request.Time)
+		}
+	}
+	entry.Time = durationMillis(elapsed)
+	entry.Timings = HARTimings{Wait: entry.Time}
+	if event.Direction != nil {
+		entry.Comment = *event.Direction
+	}
+
+	requestHeader := eventHeader(request.Headers)
+	entry.Request = HARRequest{
+		Method:      request.Verb,
+		URL:         request.Uri,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     requestCookies(requestHeader),
+		Headers:     harHeaders(requestHeader),
+		QueryString: harQueryString(request.Uri),
+		HeadersSize: -1,
+		BodySize:    contentLengthOrUnknown(request.ContentLength),
+	}
+	if request.Body != nil && *request.Body != nil {
+		entry.Request.PostData = harPostData(requestHeader.Get("Content-Type"), *request.Body, request.TransferEncoding)
+	}
+
+	responseHeader := eventHeader(response.Headers)
+	entry.Response = HARResponse{
+		Status:      response.Status,
+		StatusText:  http.StatusText(response.Status),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     responseCookies(responseHeader),
+		Headers:     harHeaders(responseHeader),
+		Content:     HARContent{MimeType: responseHeader.Get("Content-Type")},
+		RedirectURL: responseHeader.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    contentLengthOrUnknown(response.ContentLength),
+	}
+	if response.ContentLength != nil {
+		entry.Response.Content.Size = *response.ContentLength
+	}
+	if response.Body != nil {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = harBodyText(response.Body, response.TransferEncoding)
+	}
+	return entry
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func contentLengthOrUnknown(contentLength *int64) int64 {
+	if contentLength == nil {
+		return -1
+	}
+	return *contentLength
+}
+
+// eventHeader converts event headers back to an http.Header. Events hold headers as
+// []string values, or []interface{} once they have been through JSON.
+func eventHeader(headers interface{}) http.Header {
+	header := http.Header{}
+	headerMap, _ := headers.(map[string]interface{})
+	for name, value := range headerMap {
+		switch v := value.(type) {
+		case string:
+			header.Add(name, v)
+		case []string:
+			for _, s := range v {
+				header.Add(name, s)
+			}
+		case []interface{}:
+			for _, s := range v {
+				header.Add(name, fmt.Sprint(s))
+			}
+		}
+	}
+	return header
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harQueryString(uri string) []HARNameValue {
+	query := []HARNameValue{}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return query
+	}
+	values := u.Query()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range values[name] {
+			query = append(query, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return query
+}
+
+func requestCookies(header http.Header) []HARCookie {
+	cookies := []HARCookie{}
+	for _, cookie := range (&http.Request{Header: header}).Cookies() {
+		cookies = append(cookies, HARCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return cookies
+}
+
+func responseCookies(header http.Header) []HARCookie {
+	cookies := []HARCookie{}
+	for _, cookie := range (&http.Response{Header: header}).Cookies() {
+		c := HARCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			c.Expires = cookie.Expires.Format(time.RFC3339)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies
+}
+
+// harPostData returns the request body as HAR post data. HAR post data has no
+// encoding, so base64 bodies are decoded unless they are binary, which are kept
+// base64 encoded and marked as such in the comment.
+func harPostData(mimeType string, body interface{}, transferEncoding *string) *HARPostData {
+	text, encoding := harBodyText(body, transferEncoding)
+	if encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err == nil && utf8.Valid(decoded) {
+			return &HARPostData{MimeType: mimeType, Text: string(decoded)}
+		}
+		return &HARPostData{MimeType: mimeType, Text: text, Comment: "base64"}
+	}
+	return &HARPostData{MimeType: mimeType, Text: text}
+}
+
+// harBodyText returns the body as HAR content text and its encoding. JSON bodies are
+// re-encoded as text, base64 bodies are passed through with the base64 encoding.
+func harBodyText(body interface{}, transferEncoding *string) (string, string) {
+	if transferEncoding != nil && *transferEncoding == "base64" {
+		if text, ok := body.(string); ok {
+			return text, "base64"
+		}
+	}
+	if text, ok := body.(string); ok && (transferEncoding == nil || *transferEncoding == "") {
+		return text, ""
+	}
+	text, err := json.Marshal(body)
+	if err != nil {
+		return "", ""
+	}
+	return string(text), ""
+}
+
+// HARSink collects events and writes them to rolling HAR files in a directory. A file is
+// written every maxEntries events and whenever the sink is flushed or closed.
+// Users, companies and subscriptions are ignored.
+type HARSink struct {
+	mu         sync.Mutex
+	dir        string
+	maxEntries int
+	events     []*models.EventModel
+	failing    bool // set after a failed write, so the failure is logged once
+}
+
+// NewHARSink creates the directory if needed. A maxEntries of 0 uses the default of 1000.
+func NewHARSink(dir string, maxEntries int) (*HARSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultHARMaxEntries
+	}
+	return &HARSink{dir: dir, maxEntries: maxEntries}, nil
+}
+
+func (s *HARSink) QueueEvent(event *models.EventModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if len(s.events) >= s.maxEntries {
+		return s.writeFile()
+	}
+	return nil
+}
+
+func (s *HARSink) QueueUsers(users []*models.UserModel) error {
+	return nil
+}
+
+func (s *HARSink) QueueCompanies(companies []*models.CompanyModel) error {
+	return nil
+}
+
+func (s *HARSink) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	return nil
+}
+
+func (s *HARSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeFile()
+}
+
+func (s *HARSink) Close() error {
+	return s.Flush()
+}
+
+// writeFile writes the collected events to a new HAR file. The caller must hold s.mu.
+func (s *HARSink) writeFile() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(EventsToHAR(s.events), "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, "moesif-"+strings.ReplaceAll(time.Now().UTC().Format("20060102T150405.000000000"), ".", "")+".har")
+	tmp := name + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	dropped := len(s.events)
+	// The events are dropped when the file cannot be written, so a failing
+	// directory does not grow the sink forever
+	s.events = nil
+	if err != nil {
+		os.Remove(tmp)
+		if !s.failing {
+			logger.Error("Failed to write HAR file, dropping events", "dir", s.dir, "dropped", dropped, "error", err)
+			s.failing = true
+		}
+		return err
+	}
+	s.failing = false
+	return nil
+}
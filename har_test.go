@@ -0,0 +1,78 @@
+package moesifgin
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+func TestEventsToHARBodies(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{})
+	binary := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+	r.POST("/form", func(c *gin.Context) {
+		c.Data(200, "image/png", binary)
+	})
+
+	request := httptest.NewRequest("POST", "/form", strings.NewReader("name=x&b=2"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(httptest.NewRecorder(), request)
+	events := sink.Events()
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+
+	entry := EventsToHAR(events).Log.Entries[0]
+	if postData := entry.Request.PostData; postData == nil || postData.Text != "name=x&b=2" || postData.Comment != "" {
+		t.Errorf("postData = %+v, want the decoded form body", postData)
+	}
+	content := entry.Response.Content
+	if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("content = %+v, want the base64 encoded binary body", content)
+	}
+}
+
+func TestHARPostDataKeepsBinaryEncoded(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte{0x00, 0xff, 0xfe})
+	base64Encoding := "base64"
+	postData := harPostData("application/octet-stream", encoded, &base64Encoding)
+	if postData.Text != encoded || postData.Comment != "base64" {
+		t.Errorf("postData = %+v, want the base64 text marked as base64", postData)
+	}
+}
+
+func TestHARSinkDropsEventsItCannotWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "har")
+	s, err := NewHARSink(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the directory with a file, so writes fail even when running as root
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	failures := 0
+	for i := 0; i < 10; i++ {
+		if err := s.QueueEvent(&models.EventModel{}); err != nil {
+			failures++
+		}
+	}
+	if failures != 5 {
+		t.Errorf("got %d failed writes, want 5", failures)
+	}
+	if len(s.events) != 0 {
+		t.Errorf("sink holds %d events after failed writes, want 0", len(s.events))
+	}
+	if err := s.Flush(); err != nil {
+		t.Errorf("Flush with no events returned %v", err)
+	}
+}
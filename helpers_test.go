@@ -0,0 +1,54 @@
+package moesifgin
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// testSink records the events queued by the middleware
+type testSink struct {
+	mu     sync.Mutex
+	events []*models.EventModel
+}
+
+func (s *testSink) QueueEvent(event *models.EventModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *testSink) QueueUsers(users []*models.UserModel) error { return nil }
+
+func (s *testSink) QueueCompanies(companies []*models.CompanyModel) error { return nil }
+
+func (s *testSink) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	return nil
+}
+
+func (s *testSink) Flush() error { return nil }
+
+func (s *testSink) Close() error { return nil }
+
+func (s *testSink) Events() []*models.EventModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.EventModel(nil), s.events...)
+}
+
+// newTestEngine configures the middleware with options, recording events synchronously
+func newTestEngine(t *testing.T, options map[string]interface{}) (*gin.Engine, *testSink) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	sink := &testSink{}
+	options["Event_Sink"] = sink
+	options["Synchronous"] = true
+	Reset()
+	t.Cleanup(Reset)
+	r := gin.New()
+	r.Use(MoesifMiddleware(options))
+	return r, sink
+}
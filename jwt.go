@@ -0,0 +1,422 @@
+package moesifgin
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	jwtContextKey             = "moesif.jwt"
+	defaultJWTHeader          = "Authorization"
+	defaultJWTUserClaim       = "sub"
+	defaultJWTCompanyClaim    = "org_id"
+	defaultJWKSReloadInterval = time.Minute
+	jwtSessionTokenPrefix     = "jwt_"
+	jwtMaxTokenLength         = 16 * 1024
+)
+
+// jwtConfig is set by the JWT_* options, nil when JWT identity extraction is disabled
+type jwtConfig struct {
+	header         string
+	userClaim      string
+	companyClaim   string
+	metadataClaims map[string]string
+	keys           []crypto.PublicKey
+	jwks           *jwkSet
+}
+
+var jwtIdentity *jwtConfig
+
+// jwtToken is the decoded bearer token of a request
+type jwtToken struct {
+	claims       map[string]interface{}
+	sessionToken string
+}
+
+// jwtOption reads the JWT_* options
+func jwtOption(moesifOption map[string]interface{}) *jwtConfig {
+	if enabled, _ := moesifOption["JWT_Identity"].(bool); !enabled {
+		return nil
+	}
+	config := &jwtConfig{
+		header:       defaultJWTHeader,
+		userClaim:    defaultJWTUserClaim,
+		companyClaim: defaultJWTCompanyClaim,
+	}
+	if header, found := moesifOption["JWT_Header"].(string); found && header != "" {
+		config.header = header
+	}
+	if claim, found := moesifOption["JWT_User_Claim"].(string); found {
+		config.userClaim = claim
+	}
+	if claim, found := moesifOption["JWT_Company_Claim"].(string); found {
+		config.companyClaim = claim
+	}
+	config.metadataClaims, _ = moesifOption["JWT_Metadata_Claims"].(map[string]string)
+	config.keys, _ = moesifOption["JWT_Keys"].([]crypto.PublicKey)
+	if path, found := moesifOption["JWT_JWKS_File"].(string); found && path != "" {
+		if jwtIdentity != nil && jwtIdentity.jwks != nil && jwtIdentity.jwks.path == path {
+			// Already loaded and watched
+			config.jwks = jwtIdentity.jwks
+			return config
+		}
+		jwks, err := loadJWKSet(path)
+		if err != nil {
+			// Verification stays required, so no token is trusted until the file is fixed
+			logger.Error("Could not load the JWKS file", "path", path, "error", err)
+		}
+		config.jwks = jwks
+		go jwks.reloadLoop(defaultJWKSReloadInterval)
+	}
+	return config
+}
+
+// verifying reports whether tokens must carry a valid signature
+func (j *jwtConfig) verifying() bool {
+	return len(j.keys) > 0 || j.jwks != nil
+}
+
+// token returns the decoded token of the request, parsing it once per request
+func (j *jwtConfig) token(c *gin.Context) *jwtToken {
+	if value, found := c.Get(jwtContextKey); found {
+		token, _ := value.(*jwtToken)
+		return token
+	}
+	token, err := j.parse(c.Request.Header.Get(j.header))
+	if err != nil {
+		logger.Debug("Ignoring JWT", requestAttrs(c, "reason", err.Error())...)
+		token = nil
+	}
+	c.Set(jwtContextKey, token)
+	return token
+}
+
+func (j *jwtConfig) parse(value string) (*jwtToken, error) {
+	raw := strings.TrimSpace(value)
+	if scheme, token, found := strings.Cut(raw, " "); found && strings.EqualFold(scheme, "Bearer") {
+		raw = strings.TrimSpace(token)
+	}
+	if raw == "" {
+		return nil, errors.New("no token")
+	}
+	if len(raw) > jwtMaxTokenLength {
+		return nil, errors.New("token too long")
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if j.verifying() {
+		signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+		if err != nil {
+			return nil, err
+		}
+		var keys []crypto.PublicKey
+		if j.jwks != nil {
+			keys = append(keys, j.jwks.find(header.Kid)...)
+		}
+		keys = append(keys, j.keys...)
+		if !verifyJWT(header.Alg, []byte(parts[0]+"."+parts[1]), signature, keys) {
+			return nil, errors.New("invalid signature")
+		}
+		if err := validateJWTTime(claims); err != nil {
+			return nil, err
+		}
+	}
+
+	digest := sha256.Sum256([]byte(raw))
+	return &jwtToken{
+		claims:       claims,
+		sessionToken: jwtSessionTokenPrefix + hex.EncodeToString(digest[:]),
+	}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // Keep numeric ids intact
+	return decoder.Decode(v)
+}
+
+// validateJWTTime checks the exp and nbf claims of a verified token
+func validateJWTTime(claims map[string]interface{}) error {
+	now := time.Now().Unix()
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if seconds, err := exp.Int64(); err != nil || now >= seconds {
+			return errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if seconds, err := nbf.Int64(); err != nil || now < seconds {
+			return errors.New("token not valid yet")
+		}
+	}
+	return nil
+}
+
+// verifyJWT checks the signature against each key usable with the algorithm
+func verifyJWT(alg string, signed []byte, signature []byte, keys []crypto.PublicKey) bool {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") && hash != 0 && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return true
+			}
+			if strings.HasPrefix(alg, "PS") && hash != 0 &&
+				rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(alg, "ES") && hash != 0 && len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				if ecdsa.Verify(key, digest, r, s) {
+					return true
+				}
+			}
+		case ed25519.PublicKey:
+			if alg == "EdDSA" && ed25519.Verify(key, signed, signature) {
+				return true
+			}
+		case []byte:
+			if strings.HasPrefix(alg, "HS") && hash != 0 {
+				mac := hmac.New(hash.New, key)
+				mac.Write(signed)
+				if hmac.Equal(mac.Sum(nil), signature) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns the claim at a dotted path as a string
+func (t *jwtToken) claimString(path string) string {
+	if path == "" {
+		return ""
+	}
+	value, found := walkPath(t.claims, strings.Split(path, "."))
+	if !found {
+		return ""
+	}
+	return stringValue(value)
+}
+
+// jwtField returns the user id, company id or session token from the request's JWT
+func jwtField(fieldName string, c *gin.Context) string {
+	if jwtIdentity == nil {
+		return ""
+	}
+	token := jwtIdentity.token(c)
+	if token == nil {
+		return ""
+	}
+	switch fieldName {
+	case "Identify_User":
+		return token.claimString(jwtIdentity.userClaim)
+	case "Identify_Company":
+		return token.claimString(jwtIdentity.companyClaim)
+	case "Get_Session_Token":
+		return token.sessionToken
+	}
+	return ""
+}
+
+// jwtMetadata adds the claims declared with JWT_Metadata_Claims
+func jwtMetadata(c *gin.Context, metadata map[string]interface{}) map[string]interface{} {
+	if jwtIdentity == nil || len(jwtIdentity.metadataClaims) == 0 {
+		return metadata
+	}
+	token := jwtIdentity.token(c)
+	if token == nil {
+		return metadata
+	}
+	for name, path := range jwtIdentity.metadataClaims {
+		if value, found := walkPath(token.claims, strings.Split(path, ".")); found {
+			metadata = addMetadata(metadata, name, value)
+		}
+	}
+	return metadata
+}
+
+// jwkSet holds the keys of a JWKS file, reloaded when it changes on disk
+type jwkSet struct {
+	path    string
+	keys    atomic.Pointer[map[string][]crypto.PublicKey]
+	modTime time.Time
+}
+
+func loadJWKSet(path string) (*jwkSet, error) {
+	set := &jwkSet{path: path}
+	set.keys.Store(&map[string][]crypto.PublicKey{})
+	return set, set.reload()
+}
+
+func (s *jwkSet) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.keys.Store(&keys)
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *jwkSet) reloadLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.reload(); err != nil {
+			logger.Warn("Could not reload the JWKS file", "path", s.path, "error", err)
+		}
+	}
+}
+
+// find returns the keys with the key id, or all keys if the token has none
+func (s *jwkSet) find(kid string) []crypto.PublicKey {
+	keys := *s.keys.Load()
+	if kid != "" {
+		return keys[kid]
+	}
+	var all []crypto.PublicKey
+	for _, k := range keys {
+		all = append(all, k...)
+	}
+	return all
+}
+
+// jsonWebKey holds the members of a JSON Web Key used to verify signatures. Other members,
+// such as the x5c certificate chain or key_ops, are ignored.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses a JSON Web Key Set, grouping the keys by key id
+func parseJWKS(data []byte) (map[string][]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			// Encryption keys
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			logger.Warn("Ignoring JSON Web Key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = append(keys[jwk.Kid], key)
+	}
+	return keys, nil
+}
+
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	param := func(value string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		return b
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, e := param(jwk.N), param(jwk.E)
+		if len(n) == 0 || len(e) == 0 {
+			return nil, errors.New("missing RSA parameters")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(param(jwk.X)), Y: new(big.Int).SetBytes(param(jwk.Y))}, nil
+	case "OKP":
+		x := param(jwk.X)
+		if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return param(jwk.K), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
@@ -0,0 +1,153 @@
+package moesifgin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestKey(t *testing.T, path string) crypto.Signer {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(crypto.Signer)
+}
+
+// signTestJWT signs a token with alg, using an RSA or EC private key or an HMAC secret
+func signTestJWT(t *testing.T, alg string, kid string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case nil:
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseJWKSFromProviders(t *testing.T) {
+	data, err := os.ReadFile("testdata/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatalf("parseJWKS: %v", err)
+	}
+	for _, kid := range []string{"rsa-2024", "azure-other", "ec-2024"} {
+		if len(keys[kid]) != 1 {
+			t.Errorf("got %d keys for kid %q, want 1", len(keys[kid]), kid)
+		}
+	}
+	if len(keys["enc-2024"]) != 0 {
+		t.Errorf("encryption key was loaded for verification")
+	}
+}
+
+func TestJWTVerification(t *testing.T) {
+	jwks, err := loadJWKSet("testdata/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := loadTestKey(t, "testdata/jwt_rsa.pem")
+	ecKey := loadTestKey(t, "testdata/jwt_ec.pem")
+	secret := []byte("hmac-secret")
+	config := &jwtConfig{keys: []crypto.PublicKey{secret}, jwks: jwks}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "user-1", "exp": now + 3600, "nbf": now - 60}
+	expired := map[string]interface{}{"sub": "user-1", "exp": now - 60}
+	notYet := map[string]interface{}{"sub": "user-1", "nbf": now + 3600}
+
+	// A valid signature over other claims
+	tampered := strings.Split(signTestJWT(t, "RS256", "rsa-2024", valid, rsaKey), ".")
+	tampered[1] = strings.Split(signTestJWT(t, "RS256", "rsa-2024", map[string]interface{}{"sub": "admin"}, rsaKey), ".")[1]
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256 with kid", signTestJWT(t, "RS256", "rsa-2024", valid, rsaKey), true},
+		{"RS256 without kid", signTestJWT(t, "RS256", "", valid, rsaKey), true},
+		{"PS256", signTestJWT(t, "PS256", "rsa-2024", valid, rsaKey), true},
+		{"ES256", signTestJWT(t, "ES256", "ec-2024", valid, ecKey), true},
+		{"HS256 with configured secret", signTestJWT(t, "HS256", "", valid, secret), true},
+		{"kid of another key", signTestJWT(t, "RS256", "azure-other", valid, rsaKey), false},
+		{"unknown kid", signTestJWT(t, "RS256", "rotated-away", valid, rsaKey), false},
+		{"encryption key kid", signTestJWT(t, "RS256", "enc-2024", valid, rsaKey), false},
+		{"expired", signTestJWT(t, "RS256", "rsa-2024", expired, rsaKey), false},
+		{"not valid yet", signTestJWT(t, "RS256", "rsa-2024", notYet, rsaKey), false},
+		{"alg none", signTestJWT(t, "none", "rsa-2024", valid, nil), false},
+		{"alg mismatch", signTestJWT(t, "ES256", "rsa-2024", valid, rsaKey), false},
+		{"HS256 with the RSA key as secret", signTestJWT(t, "HS256", "rsa-2024", valid, []byte(jwks.find("rsa-2024")[0].(*rsa.PublicKey).N.Bytes())), false},
+		{"wrong secret", signTestJWT(t, "HS256", "", valid, []byte("other")), false},
+		{"tampered claims", strings.Join(tampered, "."), false},
+		{"not a JWT", "abc.def", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := config.parse("Bearer " + test.token)
+			if test.valid && err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("parse accepted the token")
+			}
+			if test.valid && token.claimString("sub") != "user-1" {
+				t.Errorf("sub = %q, want user-1", token.claimString("sub"))
+			}
+		})
+	}
+}
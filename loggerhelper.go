@@ -1,11 +1,13 @@
 package moesifgin
 
 import (
+	"context"
 	b64 "encoding/base64"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,10 +22,23 @@ func contains(arr []string, str string) bool {
 }
 
 func getConfigStringValuesForIncomingEvent(fieldName string, c *gin.Context) string {
+	if callback := routeIdentify(c, fieldName); callback != nil {
+		if value := callback(c); value != "" {
+			return value
+		}
+	}
+	if value := declaredString(fieldName, c); value != "" {
+		return value
+	}
 	if callback, found := moesifOption[fieldName]; found {
-		return callback.(func(c *gin.Context) string)(c)
+		if value := callback.(func(c *gin.Context) string)(c); value != "" {
+			return value
+		}
 	}
-	return ""
+	if value := jwtField(fieldName, c); value != "" {
+		return value
+	}
+	return apiKeyField(fieldName, c)
 }
 
 func getConfigStringValuesForOutgoingEvent(fieldName string, request *http.Request, response *http.Response) string {
@@ -33,6 +48,16 @@ func getConfigStringValuesForOutgoingEvent(fieldName string, request *http.Reque
 	return ""
 }
 
+// addMetadata sets key in a copy of metadata, so maps returned by user callbacks are not modified
+func addMetadata(metadata map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(metadata)+1)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged[key] = value
+	return merged
+}
+
 func HeaderToMap(header http.Header) map[string]interface{} {
 	headerMap := make(map[string]interface{})
 	for name, values := range header {
@@ -41,10 +66,16 @@ func HeaderToMap(header http.Header) map[string]interface{} {
 	return headerMap
 }
 
-func maskHeaders(headers map[string]interface{}, fieldName string) map[string]interface{} {
-	var maskFields []string
-	if _, found := moesifOption[fieldName]; found {
-		maskFields = moesifOption[fieldName].(func() []string)()
+// configuredMasks returns the fields to mask from the mask option fieldName, e.g. Request_Body_Masks
+func configuredMasks(fieldName string) []string {
+	if callback, found := moesifOption[fieldName]; found {
+		return callback.(func() []string)()
+	}
+	return nil
+}
+
+func maskHeaders(headers map[string]interface{}, maskFields []string) map[string]interface{} {
+	if len(maskFields) > 0 {
 		headers = maskData(headers, maskFields)
 	}
 	return headers
@@ -56,39 +87,36 @@ func maskData(data map[string]interface{}, maskBody []string) map[string]interfa
 		case map[string]interface{}:
 			if contains(maskBody, key) {
 				data[key] = "*****"
+				atomic.AddInt64(&metrics.fieldsMasked, 1)
 			} else {
 				maskData(val.(map[string]interface{}), maskBody)
 			}
 		default:
 			if contains(maskBody, key) {
 				data[key] = "*****"
+				atomic.AddInt64(&metrics.fieldsMasked, 1)
 			}
 		}
 	}
 	return data
 }
 
-func parseBody(readReqBody []byte, fieldName string) (interface{}, string) {
+func parseBody(readReqBody []byte, maskFields []string) (interface{}, string) {
 	var body interface{}
 	bodyEncoding := "json"
 	if jsonMarshalErr := json.Unmarshal(readReqBody, &body); jsonMarshalErr != nil {
-		if debug {
-			log.Printf("About to parse body as base64 ")
-		}
 		body = b64.StdEncoding.EncodeToString(readReqBody)
 		bodyEncoding = "base64"
-		if debug {
-			log.Printf("Parsed body as base64 - %s", body)
+		if traceEnabled() {
+			logger.Log(context.Background(), LevelTrace, "Encoded body that is not JSON as base64", "body", body)
 		}
 	} else {
 		// If the body is a JSON object, optionally mask selected fields from logging
-		var maskFields []string
-		if _, found := moesifOption[fieldName]; found {
-			maskFields = moesifOption[fieldName].(func() []string)()
+		if len(maskFields) > 0 {
 			if mappedBody, ok := body.(map[string]interface{}); ok {
 				body = maskData(mappedBody, maskFields)
 			} else {
-				log.Printf("Expected body to be a map but got: %T", body)
+				logger.Debug("Body is not a JSON object, not masking it", "type", fmt.Sprintf("%T", body))
 			}
 		}
 	}
@@ -102,9 +130,7 @@ func getContentLength(headers http.Header, body []byte) (contentLength *int64) {
 	if contentLengthStr := headers.Get("Content-Length"); contentLengthStr != "" {
 		parsedLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
 		if err != nil {
-			if debug {
-				log.Printf("Error while parsing content-length: %s.\n", err)
-			}
+			logger.Debug("Could not parse Content-Length", "error", err)
 		} else {
 			contentLength = &parsedLength
 		}
@@ -0,0 +1,43 @@
+package moesifgin
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LevelTrace is the level below slog.LevelDebug. Request and response body contents are
+// only ever logged at this level.
+const LevelTrace = slog.Level(-8)
+
+var logger = newDefaultLogger(false)
+
+// newDefaultLogger logs text to stderr, including debug messages if debug is set
+func newDefaultLogger(debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// loggerOption returns the Logger option, or the default logger honoring the Debug option
+func loggerOption(moesifOption map[string]interface{}) *slog.Logger {
+	if l, found := moesifOption["Logger"].(*slog.Logger); found && l != nil {
+		return l
+	}
+	isDebug, _ := moesifOption["Debug"].(bool)
+	return newDefaultLogger(isDebug)
+}
+
+// traceEnabled reports whether body contents may be logged
+func traceEnabled() bool {
+	return logger.Enabled(context.Background(), LevelTrace)
+}
+
+// requestAttrs returns the structured fields identifying an incoming request
+func requestAttrs(c *gin.Context, attrs ...interface{}) []interface{} {
+	return append([]interface{}{"transaction_id", TransactionID(c), "route", c.FullPath()}, attrs...)
+}
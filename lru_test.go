@@ -0,0 +1,71 @@
+package moesifgin
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", 1)
+	c.add("b", 2)
+	// Reading a makes b the least recently used
+	if value, found := c.get("a"); !found || value != 1 {
+		t.Fatalf("get(a) = %v, %v", value, found)
+	}
+	c.add("c", 3)
+	if _, found := c.get("b"); found {
+		t.Error("b was not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if value, found := c.get(key); !found || value != want {
+			t.Errorf("get(%s) = %v, %v, want %d", key, value, found, want)
+		}
+	}
+
+	// Updating a key refreshes it without growing the cache
+	c.add("a", 10)
+	c.add("d", 4)
+	if _, found := c.get("c"); found {
+		t.Error("c was not evicted")
+	}
+	if value, _ := c.get("a"); value != 10 {
+		t.Errorf("get(a) = %v, want 10", value)
+	}
+	if n := c.order.Len(); n != 2 || len(c.entries) != 2 {
+		t.Errorf("cache holds %d entries and %d keys, want 2", n, len(c.entries))
+	}
+
+	c.purge()
+	if _, found := c.get("a"); found {
+		t.Error("a was not purged")
+	}
+}
+
+func TestLRUCacheConcurrentUse(t *testing.T) {
+	const size = 16
+	c := newLRUCache(size)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprint(i % 32)
+				if value, found := c.get(key); found && value != key {
+					t.Errorf("get(%s) = %v", key, value)
+					return
+				}
+				c.add(key, key)
+				if i%250 == g {
+					c.purge()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.order.Len(); n > size || n != len(c.entries) {
+		t.Errorf("cache holds %d entries and %d keys, want at most %d", n, len(c.entries), size)
+	}
+}
@@ -0,0 +1,157 @@
+package moesifgin
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the middleware overhead histogram buckets
+var overheadBuckets = []float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1}
+
+// middlewareMetrics counts what the middleware captures, drops and costs
+type middlewareMetrics struct {
+	requestsSeen          int64
+	eventsCaptured        int64
+	eventsSkipped         int64
+	eventsSampledOut      int64
+	eventsQueued          int64
+	eventsQueueErrors     int64
+	eventsOverflowed      int64
+	fieldsMasked          int64
+	sendFailures          int64
+	bodyBytesBuffered     int64
+	configRefreshes       int64
+	configRefreshFailures int64
+	overhead              histogram
+}
+
+var metrics = &middlewareMetrics{overhead: newHistogram(overheadBuckets)}
+
+// histogram is a cumulative histogram safe for concurrent use
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// snapshot returns copies of the cumulative bucket counts, total count and sum
+func (h *histogram) snapshot() ([]uint64, uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]uint64(nil), h.buckets...), h.count, h.sum
+}
+
+func (m *middlewareMetrics) observeOverhead(d time.Duration) {
+	m.overhead.observe(d.Seconds())
+}
+
+// queueDepth returns the number of events waiting in the in-memory queue
+func queueDepth() int {
+	if sender == nil {
+		return 0
+	}
+	return len(sender.queue)
+}
+
+type metricValue struct {
+	name  string
+	help  string
+	kind  string
+	value int64
+}
+
+func (m *middlewareMetrics) values() []metricValue {
+	return []metricValue{
+		{"moesifgin_requests_seen", "Requests handled by the middleware, including those skipped before the handlers ran.", "counter", atomic.LoadInt64(&m.requestsSeen)},
+		{"moesifgin_events_captured", "Requests and responses captured by the middleware and outgoing calls captured.", "counter", atomic.LoadInt64(&m.eventsCaptured)},
+		{"moesifgin_events_skipped", "Events skipped by skip rules.", "counter", atomic.LoadInt64(&m.eventsSkipped)},
+		{"moesifgin_events_sampled_out", "Events dropped by sampling.", "counter", atomic.LoadInt64(&m.eventsSampledOut)},
+		{"moesifgin_events_queued", "Events handed to the event sink.", "counter", atomic.LoadInt64(&m.eventsQueued)},
+		{"moesifgin_events_queue_errors", "Events the event sink refused, e.g. because its queue was full.", "counter", atomic.LoadInt64(&m.eventsQueueErrors)},
+		{"moesifgin_events_overflowed", "Events dropped because the event worker queue was full.", "counter", atomic.LoadInt64(&m.eventsOverflowed)},
+		{"moesifgin_fields_masked", "Header and body fields replaced by masks.", "counter", atomic.LoadInt64(&m.fieldsMasked)},
+		{"moesifgin_send_failures", "Failed calls to the Moesif collector.", "counter", atomic.LoadInt64(&m.sendFailures)},
+		{"moesifgin_body_bytes_buffered", "Request and response body bytes buffered for logging.", "counter", atomic.LoadInt64(&m.bodyBytesBuffered)},
+		{"moesifgin_config_refreshes", "Application config refreshes.", "counter", atomic.LoadInt64(&m.configRefreshes)},
+		{"moesifgin_config_refresh_failures", "Failed application config refreshes.", "counter", atomic.LoadInt64(&m.configRefreshFailures)},
+		{"moesifgin_queue_depth", "Events waiting in the in-memory queue.", "gauge", int64(queueDepth())},
+		{"moesifgin_worker_queue_depth", "Captured requests waiting to be built into events.", "gauge", int64(workerQueueDepth())},
+	}
+}
+
+// MetricsHandler serves the middleware metrics in the OpenMetrics text format, which
+// Prometheus can scrape directly
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		writeOpenMetrics(w)
+	})
+}
+
+func writeOpenMetrics(w io.Writer) {
+	for _, v := range metrics.values() {
+		fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", v.name, v.kind, v.name, v.help)
+		if v.kind == "counter" {
+			fmt.Fprintf(w, "%s_total %d\n", v.name, v.value)
+		} else {
+			fmt.Fprintf(w, "%s %d\n", v.name, v.value)
+		}
+	}
+
+	const name = "moesifgin_overhead_seconds"
+	buckets, count, sum := metrics.overhead.snapshot()
+	fmt.Fprintf(w, "# TYPE %s histogram\n# HELP %s Time spent in the middleware per request, excluding the handlers.\n", name, name)
+	for i, bound := range metrics.overhead.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(sum, 'g', -1, 64), name, count)
+	fmt.Fprint(w, "# EOF\n")
+}
+
+var publishExpvarOnce sync.Once
+
+// PublishExpvar publishes the middleware metrics under the "moesifgin" expvar, served on
+// /debug/vars when the expvar handler is registered
+func PublishExpvar() {
+	publishExpvarOnce.Do(func() {
+		expvar.Publish("moesifgin", expvar.Func(func() interface{} {
+			vars := make(map[string]interface{})
+			for _, v := range metrics.values() {
+				vars[v.name] = v.value
+			}
+			buckets, count, sum := metrics.overhead.snapshot()
+			histogram := make(map[string]uint64, len(buckets)+1)
+			for i, bound := range metrics.overhead.bounds {
+				histogram[strconv.FormatFloat(bound, 'g', -1, 64)] = buckets[i]
+			}
+			histogram["+Inf"] = count
+			vars["moesifgin_overhead_seconds"] = map[string]interface{}{"buckets": histogram, "count": count, "sum": sum}
+			return vars
+		}))
+	})
+}
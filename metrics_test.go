@@ -0,0 +1,31 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPreSkippedRequestsAreNotCaptured(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{
+		"Should_Skip_Pre": func(c *gin.Context) bool { return c.Request.URL.Path == "/health" },
+	})
+	r.GET("/health", func(c *gin.Context) { c.Status(204) })
+	r.GET("/orders", func(c *gin.Context) { c.String(200, "ok") })
+
+	seen, captured := atomic.LoadInt64(&metrics.requestsSeen), atomic.LoadInt64(&metrics.eventsCaptured)
+	for _, path := range []string{"/health", "/orders", "/health"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if n := atomic.LoadInt64(&metrics.requestsSeen) - seen; n != 3 {
+		t.Errorf("requests seen = %d, want 3", n)
+	}
+	if n := atomic.LoadInt64(&metrics.eventsCaptured) - captured; n != 1 {
+		t.Errorf("events captured = %d, want 1", n)
+	}
+	if n := len(sink.Events()); n != 1 {
+		t.Errorf("got %d events, want 1", n)
+	}
+}
@@ -5,12 +5,10 @@ package moesifgin
 
 import (
 	"bytes"
-	"crypto/rand"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,12 +18,13 @@ import (
 
 var (
 	apiClient            moesifapi.API
-	debug                bool
 	moesifOption         map[string]interface{}
 	disableTransactionId bool
 	logBody              bool
 	logBodyOutgoing      bool
-	appConfig            = NewAppConfig()
+	appConfig            = newAppConfig()
+	spool                *eventSpool
+	appConfigStarted     bool
 )
 
 func MoesifMiddleware(configurationOption map[string]interface{}) gin.HandlerFunc {
@@ -36,66 +35,155 @@ func MoesifMiddleware(configurationOption map[string]interface{}) gin.HandlerFun
 	}
 
 	return gin.HandlerFunc(func(c *gin.Context) {
+		// Time spent in the middleware itself, excluding the handlers
+		overheadStart := time.Now()
+		atomic.AddInt64(&metrics.requestsSeen, 1)
+
+		// Requests skipped before the handlers run are not observed at all
+		var skipReason string
+		if skipBeforeHandler(c) {
+			skipReason = "skip_rule"
+		} else if callback, found := moesifOption["Should_Skip_Pre"]; found && callback.(func(*gin.Context) bool)(c) {
+			skipReason = "should_skip_pre"
+		}
+		if skipReason != "" {
+			logger.Debug("Skipping event", requestAttrs(c, "reason", skipReason)...)
+			atomic.AddInt64(&metrics.eventsSkipped, 1)
+			metrics.observeOverhead(time.Since(overheadStart))
+			c.Next()
+			return
+		}
+		atomic.AddInt64(&metrics.eventsCaptured, 1)
+
 		// Create a new LogGinResponseWriter to capture the response status and body for logging
 		lgw := NewLogGinResponseWriter(c.Writer)
+		lgw.ctx = c
 		c.Writer = lgw
 
+		// Decide the sampling now unless it depends on the user or company, so the bodies of
+		// requests that are sampled out are not buffered
+		if percentage, ok := upfrontSamplingPercentage(); ok {
+			c.Set(samplingContextKey, decideSampling(percentage))
+		}
+		lgw.discardBody = !capturesBodies(c)
+
 		if !disableTransactionId {
-			transactionId := c.Request.Header.Get("X-Moesif-Transaction-Id")
-			if len(transactionId) == 0 {
-				transactionId, _ = uuid()
-			}
+			transactionId := resolveTransactionId(c)
 			if len(transactionId) != 0 {
-				c.Request.Header.Set("X-Moesif-Transaction-Id", transactionId)
-				c.Writer.Header().Add("X-Moesif-Transaction-Id", transactionId)
+				c.Set(transactionIdContextKey, transactionId)
+				c.Request.Header.Set(transactionIdHeader, transactionId)
+				c.Writer.Header().Set(transactionIdHeader, transactionId)
 			}
 		}
 
-		requestTime := time.Now().UTC()
-		var body1, body2 io.ReadCloser
-		var err error
-		if logBody {
-			// buffer the entire request body into memory for logging
-			if body1, body2, err = teeBody(c.Request.Body); err != nil {
-				log.Printf("Error while reading request body: %v.\n", err)
-			} else {
-				// Body is a ReadCloser meaning that it does not implement the Seek interface
-				// It must be buffered into memory to be read more than once
-				// This is a replacement reader reading the buffer for the original server handler
-				c.Request.Body = body1
-			}
+		// Observe the connection if the handler upgrades it to a WebSocket
+		var wsSession *webSocketSession
+		if captureWebSocket && isWebSocketUpgrade(c.Request) {
+			wsSession = newWebSocketSession()
+			lgw.hijackHook = wsSession.wrap
 		}
 
+		requestTime := time.Now().UTC()
+		timing := newRequestTiming(requestTime)
+		c.Set(timingContextKey, timing)
+		lgw.timing = timing
+
+		// The body is buffered once read, so Overrides of the route decide whether it is logged
+		requestBody := newLazyRequestBody(c, timing)
+		c.Request.Body = requestBody
+
+		overhead := time.Since(overheadStart)
+		timing.handlerStart = time.Now()
+		lgw.cancel = watchCancel(c.Request.Context())
 		c.Next()
+		lgw.cancel.done()
+		lgw.cancel.observe(c.Request.Context())
+		// gin writes the header of responses without a body after the handlers, bypassing
+		// this writer, so write it here to record the time to first byte and Server-Timing
+		lgw.WriteHeaderNow()
+		// A body the handlers did not read is buffered now if it is logged
+		requestBody.buffer()
 
 		// Response Time
 		responseTime := time.Now().UTC()
-
-		shouldSkip := false
-		if callback, found := moesifOption["Should_Skip"]; found {
-			shouldSkip = callback.(func(*gin.Context) bool)(c)
+		timing.mu.Lock()
+		timing.handlerEnd = responseTime
+		timing.mu.Unlock()
+		overheadStart = time.Now()
+
+		sampling := samplingDecisionOf(c)
+		if sampling != nil && !sampling.sampled {
+			skipReason = "sampling"
+		} else if skipAfterHandler(c, lgw.status) {
+			skipReason = "skip_rule"
+		} else if skip, overridden := routeSkip(c); overridden {
+			if skip {
+				skipReason = "route_override"
+			}
+		} else if callback, found := moesifOption["Should_Skip"]; found && callback.(func(*gin.Context) bool)(c) {
+			skipReason = "should_skip"
 		}
 
-		if shouldSkip {
-			if debug {
-				log.Printf("Skip sending the event to Moesif")
-			}
-		} else {
-			if debug {
-				log.Printf("Sending the event to Moesif")
+		if skipReason != "" {
+			if skipReason == "sampling" {
+				logger.Debug("Skipping event", requestAttrs(c, "reason", skipReason,
+					"sampling_percentage", sampling.percentage, "random_percentage", sampling.random)...)
+				atomic.AddInt64(&metrics.eventsSampledOut, 1)
+			} else {
+				logger.Debug("Skipping event", requestAttrs(c, "reason", skipReason)...)
+				atomic.AddInt64(&metrics.eventsSkipped, 1)
 			}
-			if logBody {
-				// this is a separate ReadCloser, reading the same buffer as above for logging
-				c.Request.Body = body2
+			if wsSession != nil {
+				wsSession.skip()
 			}
-			sendEvent(c, lgw, requestTime, responseTime)
+		} else {
+			logger.Debug("Sending event", requestAttrs(c)...)
+			sendEvent(c, lgw, requestTime, responseTime, wsSession)
 		}
+		metrics.observeOverhead(overhead + time.Since(overheadStart))
 	})
 }
 
+// Reset stops sending events and forgets the options, so the next call to
+// MoesifMiddleware or StartCaptureOutgoing applies its options. The options are otherwise
+// only read once per process. Reset is meant for tests configuring the middleware more
+// than once, e.g. with t.Cleanup(moesifgin.Reset), and must not be called while requests
+// are being served. Events that were queued are sent first, custom sinks are not closed.
+func Reset() {
+	if apiClient == nil {
+		return
+	}
+	if eventWorkers != nil {
+		eventWorkers.close()
+		eventWorkers = nil
+	}
+	if spool != nil {
+		spool.close()
+		spool = nil
+	}
+	if sender != nil {
+		sender.close()
+		sender = nil
+	}
+	if geoIP != nil {
+		close(geoIP.stop)
+		geoIP = nil
+	}
+	if appConfigStarted {
+		appConfig.close()
+	}
+	apiClient.Close()
+	apiClient = nil
+	// Retries scheduled by the previous update loop only notify the previous config
+	appConfig = newAppConfig()
+	appConfigStarted = false
+	moesifOption = nil
+}
+
 // Initialize the client
 func moesifClient(moesifOption map[string]interface{}) {
-	log.Println("moesifClient update")
+	logger = loggerOption(moesifOption)
+	logger.Debug("Configuring the Moesif client")
 
 	var apiEndpoint string
 	var batchSize int
@@ -122,16 +210,34 @@ func moesifClient(moesifOption map[string]interface{}) {
 		timerWakeupSeconds = timer
 	}
 
-	api := moesifapi.NewAPI(moesifOption["Application_Id"].(string), &apiEndpoint, eventQueueSize, batchSize, timerWakeupSeconds)
+	// The application id is only optional when sending to a custom sink
+	applicationId, _ := moesifOption["Application_Id"].(string)
+	customSink, hasCustomSink := moesifOption["Event_Sink"].(EventSink)
+	if applicationId == "" && !hasCustomSink {
+		logger.Error("Application_Id is required to send events to Moesif")
+	}
+
+	api := moesifapi.NewAPI(applicationId, &apiEndpoint, eventQueueSize, batchSize, timerWakeupSeconds)
 	api.SetEventsHeaderCallback("X-Moesif-Config-ETag", appConfig.Notify)
 	apiClient = api
 
-	//  Disable debug by default
-	debug = false
-	// Try to fetch the debug from the option
-	if isDebug, found := moesifOption["Debug"].(bool); found {
-		debug = isDebug
+	// Events are batched and sent by our own pipeline, which retries failed batches
+	if sender == nil {
+		sender = newEventSender(eventQueueSize, batchSize, timerWakeupSeconds)
+	}
+	maxSendAttempts = defaultMaxSendAttempts
+	if attempts, found := moesifOption["Max_Send_Attempts"].(int); found && attempts > 0 {
+		maxSendAttempts = attempts
 	}
+	breakerThreshold := defaultCircuitBreakerThreshold
+	if threshold, found := moesifOption["Circuit_Breaker_Threshold"].(int); found && threshold > 0 {
+		breakerThreshold = threshold
+	}
+	breakerCooldown := defaultCircuitBreakerCooldown
+	if cooldown, found := moesifOption["Circuit_Breaker_Cooldown_Seconds"].(int); found && cooldown > 0 {
+		breakerCooldown = time.Duration(cooldown) * time.Second
+	}
+	breaker.configure(breakerThreshold, breakerCooldown)
 
 	// Disable TransactionId by default
 	disableTransactionId = false
@@ -139,6 +245,7 @@ func moesifClient(moesifOption map[string]interface{}) {
 	if isEnabled, found := moesifOption["disableTransactionId"].(bool); found {
 		disableTransactionId = isEnabled
 	}
+	transactionIdOptions(moesifOption)
 
 	// Enable logBody by default
 	logBody = true
@@ -147,19 +254,125 @@ func moesifClient(moesifOption map[string]interface{}) {
 		logBody = isEnabled
 	}
 
-	// run goroutine to check end point for updates
-	appConfig.Go()
-}
+	// Honor forwarded headers from any client unless trusted proxies are configured
+	trustedProxies = trustedProxiesOption(moesifOption)
+	clientIpHeaders = clientIpHeadersOption(moesifOption)
+	useGinClientIp = false
+	if isEnabled, found := moesifOption["Use_Gin_Client_IP"].(bool); found {
+		useGinClientIp = isEnabled
+	}
 
-// Function to generate UUID
-func uuid() (string, error) {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+	// Look up the client IP in local MaxMind databases
+	if paths, found := moesifOption["GeoIP_Databases"].([]string); found && geoIP == nil {
+		cacheSize := defaultGeoIPCacheSize
+		if size, found := moesifOption["GeoIP_Cache_Size"].(int); found && size > 0 {
+			cacheSize = size
+		}
+		reloadInterval := defaultGeoIPReloadSeconds * time.Second
+		if seconds, found := moesifOption["GeoIP_Reload_Seconds"].(int); found && seconds > 0 {
+			reloadInterval = time.Duration(seconds) * time.Second
+		}
+		if g, err := newGeoIPLookup(paths, cacheSize); err != nil {
+			logger.Error("Could not open GeoIP databases, events will not be enriched", "error", err)
+		} else {
+			geoIP = g
+			go geoIP.reloadLoop(reloadInterval)
+		}
+	}
 
-	if err != nil {
-		return "", err
+	// Requests skipped without calling Should_Skip
+	skipRules = skipRulesOption(moesifOption)
+
+	// Event fields read from context keys and headers
+	valueSourcesOption(moesifOption)
+	jwtIdentity = jwtOption(moesifOption)
+	apiKeyIdentity = apiKeyOption(moesifOption)
+
+	// Enrichers run in order on every event before it is sampled and queued
+	enrichers = enrichersOption(moesifOption)
+	outgoingEnrichers = outgoingEnrichersOption(moesifOption)
+
+	// Disable the Server-Timing header by default
+	serverTiming = false
+	if isEnabled, found := moesifOption["Server_Timing"].(bool); found {
+		serverTiming = isEnabled
+	}
+
+	// Limits for capturing streamed response bodies
+	streamCaptureMaxBytes = defaultStreamCaptureMaxBytes
+	if maxBytes, found := moesifOption["Stream_Capture_Max_Bytes"].(int); found {
+		if maxBytes > 0 {
+			streamCaptureMaxBytes = maxBytes
+		} else {
+			logger.Warn("Ignoring invalid Stream_Capture_Max_Bytes, it must be positive", "value", maxBytes, "default", defaultStreamCaptureMaxBytes)
+		}
+	}
+	streamCaptureMaxEvents = defaultStreamCaptureMaxEvents
+	if maxEvents, found := moesifOption["Stream_Capture_Max_Events"].(int); found {
+		if maxEvents >= 0 {
+			streamCaptureMaxEvents = maxEvents
+		} else {
+			logger.Warn("Ignoring invalid Stream_Capture_Max_Events, it must not be negative", "value", maxEvents, "default", defaultStreamCaptureMaxEvents)
+		}
+	}
+
+	// WebSocket session capture is opt-in
+	captureWebSocket = false
+	if isEnabled, found := moesifOption["Capture_WebSocket"].(bool); found {
+		captureWebSocket = isEnabled
+	}
+	webSocketSampleMessages = 0
+	if sampleMessages, found := moesifOption["WebSocket_Sample_Messages"].(int); found && logBody {
+		webSocketSampleMessages = sampleMessages
+	}
+
+	// Write events to an on-disk spool instead of the in-memory queue
+	if spoolDir, found := moesifOption["Spool_Dir"].(string); found && spool == nil {
+		if s, err := openSpool(spoolDir, sendEventsBatch); err != nil {
+			logger.Warn("Could not open the event spool, queueing events in memory instead", "dir", spoolDir, "error", err)
+		} else {
+			if maxBytes, found := moesifOption["Spool_Max_Segment_Bytes"].(int); found && maxBytes > 0 {
+				s.maxSegmentBytes = int64(maxBytes)
+			}
+			if maxAge, found := moesifOption["Spool_Max_Segment_Age_Seconds"].(int); found && maxAge > 0 {
+				s.maxSegmentAge = time.Duration(maxAge) * time.Second
+			}
+			if maxBytes, found := moesifOption["Spool_Max_Total_Bytes"].(int); found && maxBytes > 0 {
+				s.maxTotalBytes = int64(maxBytes)
+			}
+			if retention, found := moesifOption["Spool_Retention_Hours"].(int); found && retention > 0 {
+				s.retention = time.Duration(retention) * time.Hour
+			}
+			if batchSize > 0 {
+				s.batchSize = batchSize
+			}
+			s.start()
+			spool = s
+		}
+	}
+
+	// Send each event as it is captured instead of batching, e.g. for tests
+	synchronous = false
+	if isEnabled, found := moesifOption["Synchronous"].(bool); found {
+		synchronous = isEnabled
+	}
+	samplingRandom = samplingRandomOption(moesifOption)
+
+	// Events are built off the request goroutines unless sent synchronously
+	if eventWorkers == nil {
+		eventWorkers = eventWorkersOption(moesifOption)
+	}
+
+	eventSink = NewMoesifSink()
+	if hasCustomSink {
+		eventSink = customSink
+	}
+
+	// run goroutine to check end point for updates
+	if applicationId != "" && !appConfigStarted {
+		appConfig.Go()
+		appConfigStarted = true
 	}
-	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
 
 // Start Capture Outgoing Request
@@ -173,9 +386,7 @@ func StartCaptureOutgoing(configurationOption map[string]interface{}) {
 		moesifClient(moesifOption)
 	}
 
-	if debug {
-		log.Println("Start Capturing outgoing requests")
-	}
+	logger.Debug("Capturing outgoing requests")
 	// Enable logBody by default
 	logBodyOutgoing = true
 	// Try to fetch the disableTransactionId from the option
@@ -195,12 +406,12 @@ func UpdateUser(user *models.UserModel, configurationOption map[string]interface
 	}
 
 	// Add event to the queue
-	errUpdateUser := apiClient.QueueUser(user)
+	errUpdateUser := eventSink.QueueUsers([]*models.UserModel{user})
 	// Log the message
 	if errUpdateUser != nil {
-		log.Fatalf("Error while updating user: %s.\n", errUpdateUser.Error())
+		logger.Error("Could not queue user update", "error", errUpdateUser)
 	} else {
-		log.Println("Update User successfully added to the queue")
+		logger.Debug("Queued user update")
 	}
 }
 
@@ -213,12 +424,12 @@ func UpdateUsersBatch(users []*models.UserModel, configurationOption map[string]
 	}
 
 	// Add event to the queue
-	errUpdateUserBatch := apiClient.QueueUsers(users)
+	errUpdateUserBatch := eventSink.QueueUsers(users)
 	// Log the message
 	if errUpdateUserBatch != nil {
-		log.Fatalf("Error while updating users in batch: %s.\n", errUpdateUserBatch.Error())
+		logger.Error("Could not queue user updates", "users", len(users), "error", errUpdateUserBatch)
 	} else {
-		log.Println("Updated Users successfully added to the queue")
+		logger.Debug("Queued user updates", "users", len(users))
 	}
 }
 
@@ -231,12 +442,12 @@ func UpdateCompany(company *models.CompanyModel, configurationOption map[string]
 	}
 
 	// Add event to the queue
-	errUpdateCompany := apiClient.QueueCompany(company)
+	errUpdateCompany := eventSink.QueueCompanies([]*models.CompanyModel{company})
 	// Log the message
 	if errUpdateCompany != nil {
-		log.Fatalf("Error while updating company: %s.\n", errUpdateCompany.Error())
+		logger.Error("Could not queue company update", "error", errUpdateCompany)
 	} else {
-		log.Println("Update Company successfully added to the queue")
+		logger.Debug("Queued company update")
 	}
 }
 
@@ -249,12 +460,12 @@ func UpdateCompaniesBatch(companies []*models.CompanyModel, configurationOption
 	}
 
 	// Add event to the queue
-	errUpdateCompaniesBatch := apiClient.QueueCompanies(companies)
+	errUpdateCompaniesBatch := eventSink.QueueCompanies(companies)
 	// Log the message
 	if errUpdateCompaniesBatch != nil {
-		log.Fatalf("Error while updating companies in batch: %s.\n", errUpdateCompaniesBatch.Error())
+		logger.Error("Could not queue company updates", "companies", len(companies), "error", errUpdateCompaniesBatch)
 	} else {
-		log.Println("Updated companies successfully added to the queue")
+		logger.Debug("Queued company updates", "companies", len(companies))
 	}
 }
 
@@ -267,12 +478,12 @@ func UpdateSubscription(subscription *models.SubscriptionModel, configurationOpt
 	}
 
 	// Add event to the queue
-	errUpdateSubscription := apiClient.QueueSubscription(subscription)
+	errUpdateSubscription := eventSink.QueueSubscriptions([]*models.SubscriptionModel{subscription})
 	// Log the message
 	if errUpdateSubscription != nil {
-		log.Fatalf("Error while updating subscription: %s.\n", errUpdateSubscription.Error())
+		logger.Error("Could not queue subscription update", "error", errUpdateSubscription)
 	} else {
-		log.Println("Update Subscription successfully added to the queue")
+		logger.Debug("Queued subscription update")
 	}
 }
 
@@ -284,74 +495,101 @@ func UpdateSubscriptionsBatch(subscriptions []*models.SubscriptionModel, configu
 	}
 
 	// Add event to the queue
-	errUpdateSubscriptionsBatch := apiClient.QueueSubscriptions(subscriptions)
+	errUpdateSubscriptionsBatch := eventSink.QueueSubscriptions(subscriptions)
 	// Log the message
 	if errUpdateSubscriptionsBatch != nil {
-		log.Fatalf("Error while updating subscriptions in batch: %s.\n", errUpdateSubscriptionsBatch.Error())
+		logger.Error("Could not queue subscription updates", "subscriptions", len(subscriptions), "error", errUpdateSubscriptionsBatch)
 	} else {
-		log.Println("Updated subscriptions successfully added to the queue")
+		logger.Debug("Queued subscription updates", "subscriptions", len(subscriptions))
 	}
 }
 
-func sendEvent(c *gin.Context, response *logGinResponseWriter, reqTime time.Time, rspTime time.Time) {
-	var apiVersion *string = nil
+// sendEvent captures what the event needs from the request, whose gin.Context is reused
+// once the middleware returns, and builds the event on the worker pool
+func sendEvent(c *gin.Context, response *logGinResponseWriter, reqTime time.Time, rspTime time.Time, wsSession *webSocketSession) {
+	captured := &capturedEvent{
+		request:     c.Request,
+		clientIp:    incomingClientIp(c),
+		reqTime:     reqTime,
+		rspTime:     rspTime,
+		status:      response.status,
+		captureBody: routeLogBody(c),
+		sampling:    samplingDecisionOf(c),
+		wsSession:   wsSession,
+	}
 	if isApiVersion, found := moesifOption["Api_Version"].(string); found {
-		apiVersion = &isApiVersion
+		captured.apiVersion = &isApiVersion
 	}
 
-	// Get Request Body
-	var reqBody interface{}
-	var reqEncoding string
-	readReqBody, reqBodyErr := ioutil.ReadAll(c.Request.Body)
-	if reqBodyErr != nil {
-		if debug {
-			log.Printf("Error while reading request body: %s.\n", reqBodyErr.Error())
+	// The body buffered for logging is handed over. Otherwise what the handlers left
+	// unread is logged, unless bodies are not logged at all.
+	if body := loggedRequestBody(c); body != nil {
+		captured.reqBodyReader = body
+	} else if captured.captureBody {
+		readReqBody, reqBodyErr := ioutil.ReadAll(c.Request.Body)
+		if reqBodyErr != nil {
+			logger.Debug("Could not read request body", requestAttrs(c, "error", reqBodyErr)...)
 		}
+		captured.reqBody = readReqBody
 	}
-	reqContentLength := getContentLength(c.Request.Header, readReqBody)
 
-	// Parse the request Body if it is not empty
-	reqBody = nil
-	if logBody && (len(readReqBody)) > 0 {
-		reqBody, reqEncoding = parseBody(readReqBody, "Request_Body_Masks")
-	}
-
-	// Get the response body
-	var respBody interface{}
-	var respEncoding string
-	respBodyBuf := response.Body().Bytes()
-	respContentLength := getContentLength(response.Header(), respBodyBuf)
-
-	// Parse the response Body if it is not empty
-	respBody = nil
-	if logBody && (len(respBodyBuf)) > 0 {
-		respBody, respEncoding = parseBody(respBodyBuf, "Response_Body_Masks")
+	// The response body buffer belongs to this request's writer, so it is handed over too
+	captured.respBody = response.Body().Bytes()
+	captured.respContentLength = getContentLength(response.Header(), captured.respBody)
+	if response.streaming {
+		// Only part of a streamed body is captured, report the bytes actually streamed
+		captured.respContentLength = &response.totalBytes
 	}
 
 	// Get URL Scheme
 	if c.Request.URL.Scheme == "" {
 		c.Request.URL.Scheme = "http"
 	}
+	if wsSession != nil {
+		// The session summary is sent with the request long after it was served
+		captured.request = c.Request.Clone(c.Request.Context())
+	}
 
 	// Get Metadata
 	var metadata map[string]interface{} = nil
 	if _, found := moesifOption["Get_Metadata"]; found {
 		metadata = moesifOption["Get_Metadata"].(func(*gin.Context) map[string]interface{})(c)
 	}
+	metadata = declaredMetadata(c, metadata)
+	metadata = jwtMetadata(c, metadata)
+	if response.timing != nil {
+		metadata = addMetadata(metadata, "moesif_timing", response.timing.metadata(rspTime))
+	}
+	metadata = addMetadata(metadata, "moesif_response", response.responseMetadata())
+	if stream := response.streamMetadata(rspTime); stream != nil {
+		metadata = addMetadata(metadata, "moesif_stream", stream)
+	}
+	captured.metadata = metadata
 
 	// Get Event top-level variables from the configuration and the request
-	userId := getConfigStringValuesForIncomingEvent("Identify_User", c)
-	companyId := getConfigStringValuesForIncomingEvent("Identify_Company", c)
-	sessionToken := getConfigStringValuesForIncomingEvent("Get_Session_Token", c)
-	direction := "Incoming"
-
-	// Mask Headers
-	requestHeader := maskHeaders(HeaderToMap(c.Request.Header), "Request_Header_Masks")
-	responseHeader := maskHeaders(HeaderToMap(response.Header()), "Response_Header_Masks")
-
-	sendMoesifAsync(c.Request, reqTime, requestHeader, apiVersion, reqBody, &reqEncoding, reqContentLength,
-		rspTime, response.status, responseHeader, respBody, &respEncoding, respContentLength,
-		userId, companyId, &sessionToken, metadata, &direction)
+	captured.userId = getConfigStringValuesForIncomingEvent("Identify_User", c)
+	captured.companyId = getConfigStringValuesForIncomingEvent("Identify_Company", c)
+	captured.sessionToken = getConfigStringValuesForIncomingEvent("Get_Session_Token", c)
+
+	// Headers are copied now and masked with the masks of the route later
+	captured.reqHeader = HeaderToMap(c.Request.Header)
+	captured.respHeader = HeaderToMap(response.Header())
+	captured.reqHeaderMasks = routeMasks(c, "Request_Header_Masks")
+	captured.respHeaderMasks = routeMasks(c, "Response_Header_Masks")
+	captured.reqBodyMasks = routeMasks(c, "Request_Body_Masks")
+	captured.respBodyMasks = routeMasks(c, "Response_Body_Masks")
+	redactAPIKey(c, captured)
+
+	if synchronous || eventWorkers == nil {
+		captured.enrich = enrichIncoming(c)
+		captured.build()
+		return
+	}
+	if len(enrichers) > 0 {
+		// Enrichers run on a worker, after the gin.Context has been reused
+		captured.enrich = enrichIncoming(c.Copy())
+	}
+	eventWorkers.submit(captured)
 }
 
 // teeBody reads all of b to memory and then returns two equivalent
@@ -369,5 +607,6 @@ func teeBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
 	if err = b.Close(); err != nil {
 		return nil, b, err
 	}
+	atomic.AddInt64(&metrics.bodyBytesBuffered, int64(buf.Len()))
 	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
 }
@@ -0,0 +1,315 @@
+package moesifgin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// The MaxMind DB format is described at https://maxmind.github.io/MaxMind-DB/
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Data section field types
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBoolean  = 14
+	mmdbFloat    = 15
+)
+
+const (
+	// Size of the zero bytes between the search tree and the data section
+	mmdbSeparator = 16
+	// Maximum nesting of maps, arrays and pointers in a value
+	mmdbMaxDepth = 32
+)
+
+var errMMDBCorrupt = errors.New("mmdb: invalid database")
+
+// mmdbReader looks up IP addresses in a MaxMind DB file read into memory
+type mmdbReader struct {
+	tree         []byte
+	data         mmdbDecoder
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	databaseType string
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	metadataStart := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if metadataStart < 0 {
+		return nil, fmt.Errorf("mmdb: metadata not found")
+	}
+	metadataDecoder := mmdbDecoder{buf: buf[metadataStart+len(mmdbMetadataMarker):]}
+	value, _, err := metadataDecoder.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+
+	r := &mmdbReader{
+		nodeCount:  mmdbUint(metadata["node_count"]),
+		recordSize: mmdbUint(metadata["record_size"]),
+		ipVersion:  mmdbUint(metadata["ip_version"]),
+	}
+	r.databaseType, _ = metadata["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported IP version %d", r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbSeparator > uint(metadataStart) {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf: buf[treeSize+mmdbSeparator : metadataStart]}
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a search tree node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the record for addr, or nil if the database has none
+func (r *mmdbReader) lookup(addr netip.Addr) (interface{}, error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint(0)
+	if addr.Is4() {
+		ip4 := addr.As4()
+		ip = ip4[:]
+		node = r.ipv4Start
+	} else {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		ip16 := addr.As16()
+		ip = ip16[:]
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+	value, _, err := r.data.decode(node-r.nodeCount-mmdbSeparator, 0)
+	return value, err
+}
+
+// mmdbDecoder decodes values of the data section
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset and the offset following it
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth || offset >= uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		kind = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, min(size, 32))
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, min(size, 32))
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbBoolean:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return mmdbBigEndian(b), offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return int32(uint32(mmdbBigEndian(b))), offset, nil
+	case mmdbUint128:
+		if size > 16 {
+			return nil, 0, errMMDBCorrupt
+		}
+		if size <= 8 {
+			return mmdbBigEndian(b), offset, nil
+		}
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", kind)
+}
+
+// size returns the payload size encoded in the control byte and the bytes following it
+func (d *mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	extra := uint(mmdbBigEndian(d.buf[offset : offset+n]))
+	switch size {
+	case 29:
+		size = 29 + extra
+	case 30:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return size, offset + n, nil
+}
+
+// pointer returns the data section offset a pointer refers to, and the offset following it
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	pointer := uint(mmdbBigEndian(d.buf[offset : offset+n]))
+	prefix := uint(ctrl & 0x7)
+	switch n {
+	case 1:
+		pointer |= prefix << 8
+	case 2:
+		pointer = (pointer | prefix<<16) + 2048
+	case 3:
+		pointer = (pointer | prefix<<24) + 526336
+	}
+	return pointer, offset + n, nil
+}
+
+func mmdbBigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// mmdbUint converts a decoded unsigned integer to uint
+func mmdbUint(value interface{}) uint {
+	if v, ok := value.(uint64); ok {
+		return uint(v)
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package moesifgin
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+func TestMMDBLookup(t *testing.T) {
+	tests := []struct {
+		path string
+		ip   string
+		want map[string]interface{}
+	}{
+		{"testdata/geoip-city-test.mmdb", "81.2.69.160", map[string]interface{}{"country": "GB", "region": "ENG", "region_name": "England", "city": "London"}},
+		{"testdata/geoip-city-test.mmdb", "::ffff:81.2.69.160", map[string]interface{}{"country": "GB", "region": "ENG", "region_name": "England", "city": "London"}},
+		{"testdata/geoip-city-test.mmdb", "2001:db8:1::1", map[string]interface{}{"country": "DE", "city": "Berlin"}},
+		{"testdata/geoip-city-test.mmdb", "81.2.70.1", nil},
+		{"testdata/geoip-city-test.mmdb", "2001:db9::1", nil},
+		{"testdata/geoip-asn-test.mmdb", "1.128.0.1", map[string]interface{}{"asn": uint64(1221), "as_organization": "Telstra Pty Ltd, a long organization name", "hosting": true}},
+		{"testdata/geoip-asn-test.mmdb", "1.160.0.1", nil},
+		// IPv6 addresses are not in IPv4 databases
+		{"testdata/geoip-asn-test.mmdb", "2001:db8::1", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			reader, err := openMMDB(test.path)
+			if err != nil {
+				t.Fatalf("openMMDB: %v", err)
+			}
+			record, err := reader.lookup(netip.MustParseAddr(test.ip))
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			var fields map[string]interface{}
+			if record, ok := record.(map[string]interface{}); ok {
+				fields = make(map[string]interface{})
+				geoIPFields(record, fields)
+			}
+			if !reflect.DeepEqual(fields, test.want) {
+				t.Errorf("fields = %v, want %v", fields, test.want)
+			}
+		})
+	}
+}
+
+func TestMMDBLocation(t *testing.T) {
+	reader, err := openMMDB("testdata/geoip-city-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.databaseType != "Moesif-Test" || reader.recordSize != 28 || reader.ipVersion != 6 {
+		t.Errorf("metadata = %q, %d bit records, IPv%d", reader.databaseType, reader.recordSize, reader.ipVersion)
+	}
+	record, err := reader.lookup(netip.MustParseAddr("81.2.69.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latitude := mmdbPath(record, "location", "latitude"); latitude != 51.5142 {
+		t.Errorf("latitude = %v, want 51.5142", latitude)
+	}
+}
+
+func TestMMDBRejectsCorruptDatabases(t *testing.T) {
+	buf, err := os.ReadFile("testdata/geoip-city-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMMDBReader(buf[:len(buf)/2]); err == nil {
+		t.Error("opened a database without metadata")
+	}
+
+	// Point every record past the end of the data section
+	corrupt := append([]byte(nil), buf...)
+	reader, err := newMMDBReader(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range reader.data.buf {
+		reader.data.buf[i] = 0xFF
+	}
+	if _, err := reader.lookup(netip.MustParseAddr("81.2.69.1")); err == nil {
+		t.Error("looked up a record in a corrupt data section")
+	}
+}
+
+func TestGeoIPLookupMergesDatabases(t *testing.T) {
+	g, err := newGeoIPLookup([]string{"testdata/geoip-city-test.mmdb", "testdata/geoip-asn-test.mmdb"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := g.lookup("1.128.0.1")
+	if fields["asn"] != uint64(1221) || fields["country"] != nil {
+		t.Errorf("fields = %v, want only the ASN", fields)
+	}
+	if fields := g.lookup("81.2.69.1"); fields["city"] != "London" {
+		t.Errorf("fields = %v, want London", fields)
+	}
+	if fields := g.lookup("10.0.0.1"); fields != nil {
+		t.Errorf("fields = %v for an address in neither database", fields)
+	}
+	if fields := g.lookup("not an ip"); fields != nil {
+		t.Errorf("fields = %v for an invalid address", fields)
+	}
+}
+
+func TestGeoIPEnrichCopiesCachedFields(t *testing.T) {
+	g, err := newGeoIPLookup([]string{"testdata/geoip-city-test.mmdb"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := "81.2.69.1"
+	first, second := &models.EventModel{}, &models.EventModel{}
+	first.Request.IpAddress, second.Request.IpAddress = &ip, &ip
+	g.Enrich(nil, first)
+	g.Enrich(nil, second)
+
+	// An enricher after the GeoIP lookup changes the fields of one event
+	geo := first.Metadata.(map[string]interface{})["moesif_geo"].(map[string]interface{})
+	geo["city"] = "Changed"
+	if city := second.Metadata.(map[string]interface{})["moesif_geo"].(map[string]interface{})["city"]; city != "London" {
+		t.Errorf("city of the second event = %v, want London", city)
+	}
+	if fields := g.lookup(ip); fields["city"] != "London" {
+		t.Errorf("cached fields = %v, want London", fields)
+	}
+}
@@ -0,0 +1,107 @@
+package moesiftest
+
+import (
+	"sync"
+
+	"github.com/moesif/moesifapi-go/models"
+	"github.com/moesif/moesifgin"
+)
+
+// Recorder is an in-memory moesifgin.EventSink. With the Synchronous option the middleware
+// queues each event on the request goroutine, so an event is recorded by the time the
+// request has been served and tests can inspect it without waiting.
+//
+// Like Server, it only receives events if the middleware is configured with it, see moesifgin.Reset.
+//
+//	recorder := moesiftest.NewRecorder()
+//	t.Cleanup(moesifgin.Reset)
+//	r.Use(moesifgin.MoesifMiddleware(map[string]interface{}{
+//		"Event_Sink":      recorder,
+//		"Synchronous":     true,
+//		"Sampling_Random": rand.New(rand.NewSource(1)),
+//	}))
+type Recorder struct {
+	mu            sync.Mutex
+	events        []*models.EventModel
+	users         []*models.UserModel
+	companies     []*models.CompanyModel
+	subscriptions []*models.SubscriptionModel
+}
+
+var _ moesifgin.EventSink = (*Recorder)(nil)
+
+// NewRecorder returns an empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) QueueEvent(event *models.EventModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *Recorder) QueueUsers(users []*models.UserModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users = append(r.users, users...)
+	return nil
+}
+
+func (r *Recorder) QueueCompanies(companies []*models.CompanyModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.companies = append(r.companies, companies...)
+	return nil
+}
+
+func (r *Recorder) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions = append(r.subscriptions, subscriptions...)
+	return nil
+}
+
+func (r *Recorder) Flush() error {
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	return nil
+}
+
+// Events returns the events recorded so far
+func (r *Recorder) Events() []*models.EventModel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*models.EventModel(nil), r.events...)
+}
+
+// Users returns the users recorded so far
+func (r *Recorder) Users() []*models.UserModel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*models.UserModel(nil), r.users...)
+}
+
+// Companies returns the companies recorded so far
+func (r *Recorder) Companies() []*models.CompanyModel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*models.CompanyModel(nil), r.companies...)
+}
+
+// Subscriptions returns the subscriptions recorded so far
+func (r *Recorder) Subscriptions() []*models.SubscriptionModel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*models.SubscriptionModel(nil), r.subscriptions...)
+}
+
+// Reset forgets everything recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events, r.users, r.companies, r.subscriptions = nil, nil, nil, nil
+}
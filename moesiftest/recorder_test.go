@@ -0,0 +1,38 @@
+package moesiftest_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifgin"
+	"github.com/moesif/moesifgin/moesiftest"
+)
+
+func TestRecordersWithDifferentOptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(moesifgin.Reset)
+	for _, logBody := range []bool{true, false} {
+		// Without Reset the options of the first iteration would be kept
+		moesifgin.Reset()
+		recorder := moesiftest.NewRecorder()
+
+		r := gin.New()
+		r.Use(moesifgin.MoesifMiddleware(map[string]interface{}{
+			"Event_Sink":  recorder,
+			"Synchronous": true,
+			"Log_Body":    logBody,
+		}))
+		r.POST("/orders", func(c *gin.Context) { c.JSON(201, gin.H{"id": 1}) })
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/orders", strings.NewReader(`{"item":"book"}`)))
+
+		events := recorder.Events()
+		if len(events) != 1 {
+			t.Fatalf("Log_Body %v: got %d events, want 1", logBody, len(events))
+		}
+		if logged := events[0].Response.Body != nil; logged != logBody {
+			t.Errorf("Log_Body %v: response body logged %v", logBody, logged)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package moesiftest provides an in-process fake of the Moesif collector, so that
+// integrations of the moesifgin middleware can be tested without network access.
+//
+//	srv := moesiftest.NewServer()
+//	t.Cleanup(srv.Close)
+//	t.Cleanup(moesifgin.Reset)
+//	r.Use(moesifgin.MoesifMiddleware(srv.Options(nil)))
+//	...
+//	events, err := srv.WaitForEvents(1)
+//
+// The middleware reads its options once per process, so a test configuring it with
+// another server or other options must call moesifgin.Reset first. Cleanups run in
+// reverse order, so registering Reset after Close sends the queued events before the
+// server stops.
+package moesiftest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+	"github.com/moesif/moesifgin"
+)
+
+// DefaultTimeout is how long the Wait methods wait unless Server.Timeout is set
+const DefaultTimeout = 10 * time.Second
+
+// Server is a fake Moesif collector recording everything it receives
+type Server struct {
+	*httptest.Server
+
+	// Timeout for the Wait methods
+	Timeout time.Duration
+
+	mu            sync.Mutex
+	changed       chan struct{}
+	events        []*models.EventModel
+	users         []*models.UserModel
+	companies     []*models.CompanyModel
+	subscriptions []*models.SubscriptionModel
+	config        []byte
+	eTag          string
+	eTagVersion   int
+	servedETags   map[string]bool
+}
+
+// NewServer starts a fake collector serving the default application config
+func NewServer() *Server {
+	s := &Server{
+		Timeout:     DefaultTimeout,
+		changed:     make(chan struct{}),
+		servedETags: make(map[string]bool),
+	}
+	s.SetConfig(moesifgin.NewAppConfigResponse())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/events", s.handleEvents)
+	mux.HandleFunc("/v1/events/batch", s.handleEvents)
+	mux.HandleFunc("/v1/users", s.handleUsers)
+	mux.HandleFunc("/v1/users/batch", s.handleUsers)
+	mux.HandleFunc("/v1/companies", s.handleCompanies)
+	mux.HandleFunc("/v1/companies/batch", s.handleCompanies)
+	mux.HandleFunc("/v1/subscriptions", s.handleSubscriptions)
+	mux.HandleFunc("/v1/subscriptions/batch", s.handleSubscriptions)
+	mux.HandleFunc("/v1/config", s.handleConfig)
+	mux.HandleFunc("/v1/rules", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Options returns middleware options pointing at the fake collector, merged with extra
+func (s *Server) Options(extra map[string]interface{}) map[string]interface{} {
+	options := map[string]interface{}{
+		"Application_Id":        "moesiftest",
+		"Api_Endpoint":          s.URL,
+		"Timer_Wake_Up_Seconds": 1,
+	}
+	for key, value := range extra {
+		options[key] = value
+	}
+	return options
+}
+
+// SetConfig replaces the application config served on /v1/config and returns its new
+// ETag. The ETag is sent on every following events response, which makes the middleware
+// fetch the new config.
+func (s *Server) SetConfig(config moesifgin.AppConfigResponse) string {
+	body, err := json.Marshal(config)
+	if err != nil {
+		panic(fmt.Sprintf("moesiftest: cannot marshal config: %v", err))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eTagVersion++
+	s.config = body
+	s.eTag = fmt.Sprintf("moesiftest-%d", s.eTagVersion)
+	return s.eTag
+}
+
+// Events returns the events received so far
+func (s *Server) Events() []*models.EventModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.EventModel(nil), s.events...)
+}
+
+// Users returns the users received so far
+func (s *Server) Users() []*models.UserModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.UserModel(nil), s.users...)
+}
+
+// Companies returns the companies received so far
+func (s *Server) Companies() []*models.CompanyModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.CompanyModel(nil), s.companies...)
+}
+
+// Subscriptions returns the subscriptions received so far
+func (s *Server) Subscriptions() []*models.SubscriptionModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*models.SubscriptionModel(nil), s.subscriptions...)
+}
+
+// Reset forgets everything received so far, keeping the current config
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events, s.users, s.companies, s.subscriptions = nil, nil, nil, nil
+}
+
+// WaitForEvents waits until at least n events have been received and returns them
+func (s *Server) WaitForEvents(n int) ([]*models.EventModel, error) {
+	err := s.wait(fmt.Sprintf("%d events", n), func() bool { return len(s.events) >= n })
+	return s.Events(), err
+}
+
+// WaitForUsers waits until at least n users have been received and returns them
+func (s *Server) WaitForUsers(n int) ([]*models.UserModel, error) {
+	err := s.wait(fmt.Sprintf("%d users", n), func() bool { return len(s.users) >= n })
+	return s.Users(), err
+}
+
+// WaitForCompanies waits until at least n companies have been received and returns them
+func (s *Server) WaitForCompanies(n int) ([]*models.CompanyModel, error) {
+	err := s.wait(fmt.Sprintf("%d companies", n), func() bool { return len(s.companies) >= n })
+	return s.Companies(), err
+}
+
+// WaitForSubscriptions waits until at least n subscriptions have been received and returns them
+func (s *Server) WaitForSubscriptions(n int) ([]*models.SubscriptionModel, error) {
+	err := s.wait(fmt.Sprintf("%d subscriptions", n), func() bool { return len(s.subscriptions) >= n })
+	return s.Subscriptions(), err
+}
+
+// WaitForConfig waits until the config with the given ETag has been fetched by the middleware
+func (s *Server) WaitForConfig(eTag string) error {
+	return s.wait("config "+eTag, func() bool { return s.servedETags[eTag] })
+}
+
+// wait blocks until done returns true, evaluating it with s.mu held after every change
+func (s *Server) wait(what string, done func() bool) error {
+	timeout := time.NewTimer(s.Timeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		if done() {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return fmt.Errorf("moesiftest: timed out after %s waiting for %s", s.Timeout, what)
+		}
+	}
+}
+
+// notify wakes up waiters. The caller must hold s.mu.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// decode reads a single object or a batch from a possibly gzipped request body
+func decode(r *http.Request, into func(raw json.RawMessage) error) error {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return into(data)
+	}
+	for _, raw := range batch {
+		if err := into(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle decodes the request and records it, replying with the current config ETag
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, record func(raw json.RawMessage) error) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := decode(r, record); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.notify()
+	w.Header().Set("X-Moesif-Config-ETag", s.eTag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, func(raw json.RawMessage) error {
+		var event models.EventModel
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return err
+		}
+		s.events = append(s.events, &event)
+		return nil
+	})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, func(raw json.RawMessage) error {
+		var user models.UserModel
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return err
+		}
+		s.users = append(s.users, &user)
+		return nil
+	})
+}
+
+func (s *Server) handleCompanies(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, func(raw json.RawMessage) error {
+		var company models.CompanyModel
+		if err := json.Unmarshal(raw, &company); err != nil {
+			return err
+		}
+		s.companies = append(s.companies, &company)
+		return nil
+	})
+}
+
+func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, func(raw json.RawMessage) error {
+		var subscription models.SubscriptionModel
+		if err := json.Unmarshal(raw, &subscription); err != nil {
+			return err
+		}
+		s.subscriptions = append(s.subscriptions, &subscription)
+		return nil
+	})
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servedETags[s.eTag] = true
+	s.notify()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Moesif-Config-ETag", s.eTag)
+	w.Write(s.config)
+}
@@ -0,0 +1,119 @@
+package moesiftest_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/moesif/moesifapi-go/models"
+	"github.com/moesif/moesifgin"
+	"github.com/moesif/moesifgin/moesiftest"
+)
+
+func newServerEngine(t *testing.T, srv *moesiftest.Server) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	moesifgin.Reset()
+	t.Cleanup(moesifgin.Reset)
+
+	r := gin.New()
+	r.Use(moesifgin.MoesifMiddleware(srv.Options(map[string]interface{}{
+		"Synchronous": true,
+		"Identify_User": func(c *gin.Context) string {
+			return c.GetHeader("X-User-Id")
+		},
+	})))
+	r.GET("/orders", func(c *gin.Context) { c.String(200, "ok") })
+	return r
+}
+
+func serveAs(r *gin.Engine, userId string) {
+	request := httptest.NewRequest("GET", "/orders", nil)
+	request.Header.Set("X-User-Id", userId)
+	r.ServeHTTP(httptest.NewRecorder(), request)
+}
+
+func TestServerReceivesEvents(t *testing.T) {
+	srv := moesiftest.NewServer()
+	t.Cleanup(srv.Close)
+	r := newServerEngine(t, srv)
+
+	serveAs(r, "user-1")
+	serveAs(r, "user-2")
+	events, err := srv.WaitForEvents(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Request.Uri != "http://example.com/orders" || events[0].Response.Status != 200 {
+		t.Fatalf("got events %+v, want 2 GET /orders events", events)
+	}
+	if *events[0].UserId != "user-1" || *events[1].UserId != "user-2" {
+		t.Errorf("user ids = %s, %s, want user-1, user-2", *events[0].UserId, *events[1].UserId)
+	}
+
+	srv.Reset()
+	if events := srv.Events(); len(events) != 0 {
+		t.Errorf("got %d events after Reset, want 0", len(events))
+	}
+}
+
+func TestServerConfigChange(t *testing.T) {
+	srv := moesiftest.NewServer()
+	t.Cleanup(srv.Close)
+	r := newServerEngine(t, srv)
+
+	config := moesifgin.NewAppConfigResponse()
+	config.UserSampleRate = map[string]int{"blocked": 0}
+	eTag := srv.SetConfig(config)
+
+	// The events response carries the new ETag, which makes the middleware fetch the config
+	serveAs(r, "user-1")
+	if _, err := srv.WaitForEvents(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.WaitForConfig(eTag); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config is applied right after it was served, so retry until the blocked
+	// user is sampled out. Events are sent in order, so a blocked event would come first.
+	for attempt := 0; ; attempt++ {
+		srv.Reset()
+		serveAs(r, "blocked")
+		serveAs(r, "allowed")
+		events, err := srv.WaitForEvents(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *events[0].UserId == "allowed" {
+			break
+		}
+		if attempt == 10 {
+			t.Fatalf("events of the blocked user are still sent after the config with ETag %s was fetched", eTag)
+		}
+	}
+}
+
+func TestServerReceivesUsersAndCompanies(t *testing.T) {
+	srv := moesiftest.NewServer()
+	t.Cleanup(srv.Close)
+	newServerEngine(t, srv)
+
+	moesifgin.UpdateUsersBatch([]*models.UserModel{{UserId: "user-1"}, {UserId: "user-2"}}, nil)
+	moesifgin.UpdateCompaniesBatch([]*models.CompanyModel{{CompanyId: "company-1"}}, nil)
+
+	users, err := srv.WaitForUsers(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[0].UserId != "user-1" || users[1].UserId != "user-2" {
+		t.Errorf("got users %s, %s, want user-1, user-2", users[0].UserId, users[1].UserId)
+	}
+	companies, err := srv.WaitForCompanies(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if companies[0].CompanyId != "company-1" {
+		t.Errorf("got company %s, want company-1", companies[0].CompanyId)
+	}
+}
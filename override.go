@@ -0,0 +1,269 @@
+package moesifgin
+
+import (
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	overrideContextKey = "moesif.override"
+	// The request body buffered for logging, unset when it is not buffered
+	requestBodyContextKey = "moesif.requestBody"
+)
+
+// routeOverride replaces options of the middleware for the routes of a group. Fields
+// left unset fall back to the enclosing override, then to moesifOption.
+type routeOverride struct {
+	logBody            *bool
+	skip               *bool
+	samplingPercentage *int
+	// Mask fields by option name, e.g. Request_Body_Masks
+	masks map[string][]string
+	// Identification callbacks by option name, e.g. Identify_User
+	identify map[string]func(*gin.Context) string
+}
+
+// OverrideOption changes an option for the routes an Override applies to
+type OverrideOption func(*routeOverride)
+
+// Override returns a middleware changing options of MoesifMiddleware for the routes of a
+// group, e.g. router.Group("/admin", moesifgin.Override(moesifgin.WithLogBody(false))).
+// Overrides of nested groups are merged, the innermost taking precedence.
+func Override(options ...OverrideOption) gin.HandlerFunc {
+	override := &routeOverride{}
+	for _, option := range options {
+		option(override)
+	}
+	return func(c *gin.Context) {
+		merged := override
+		if parent := routeOverrideOf(c); parent != nil {
+			merged = parent.merge(override)
+		}
+		c.Set(overrideContextKey, merged)
+		if override.samplingPercentage != nil {
+			resample(c, *override.samplingPercentage)
+		}
+		updateBodyCapture(c)
+	}
+}
+
+// WithLogBody captures or omits request and response bodies
+func WithLogBody(logBody bool) OverrideOption {
+	return func(o *routeOverride) {
+		o.logBody = &logBody
+	}
+}
+
+// WithSkip skips or sends events instead of calling Should_Skip
+func WithSkip(skip bool) OverrideOption {
+	return func(o *routeOverride) {
+		o.skip = &skip
+	}
+}
+
+// WithSamplingPercentage samples events at this percentage instead of the one of the
+// application config
+func WithSamplingPercentage(percentage int) OverrideOption {
+	return func(o *routeOverride) {
+		o.samplingPercentage = &percentage
+	}
+}
+
+// WithRequestHeaderMasks replaces Request_Header_Masks. No fields turns masking off.
+func WithRequestHeaderMasks(fields ...string) OverrideOption {
+	return withMasks("Request_Header_Masks", fields)
+}
+
+// WithRequestBodyMasks replaces Request_Body_Masks. No fields turns masking off.
+func WithRequestBodyMasks(fields ...string) OverrideOption {
+	return withMasks("Request_Body_Masks", fields)
+}
+
+// WithResponseHeaderMasks replaces Response_Header_Masks. No fields turns masking off.
+func WithResponseHeaderMasks(fields ...string) OverrideOption {
+	return withMasks("Response_Header_Masks", fields)
+}
+
+// WithResponseBodyMasks replaces Response_Body_Masks. No fields turns masking off.
+func WithResponseBodyMasks(fields ...string) OverrideOption {
+	return withMasks("Response_Body_Masks", fields)
+}
+
+func withMasks(fieldName string, fields []string) OverrideOption {
+	return func(o *routeOverride) {
+		if o.masks == nil {
+			o.masks = make(map[string][]string)
+		}
+		o.masks[fieldName] = append([]string{}, fields...)
+	}
+}
+
+// WithIdentifyUser identifies users with callback, tried before the Identify_User option
+func WithIdentifyUser(callback func(*gin.Context) string) OverrideOption {
+	return withIdentify("Identify_User", callback)
+}
+
+// WithIdentifyCompany identifies companies with callback, tried before the
+// Identify_Company option
+func WithIdentifyCompany(callback func(*gin.Context) string) OverrideOption {
+	return withIdentify("Identify_Company", callback)
+}
+
+// WithSessionToken reads session tokens with callback, tried before the
+// Get_Session_Token option
+func WithSessionToken(callback func(*gin.Context) string) OverrideOption {
+	return withIdentify("Get_Session_Token", callback)
+}
+
+func withIdentify(fieldName string, callback func(*gin.Context) string) OverrideOption {
+	return func(o *routeOverride) {
+		if o.identify == nil {
+			o.identify = make(map[string]func(*gin.Context) string)
+		}
+		o.identify[fieldName] = callback
+	}
+}
+
+// merge returns a copy of o with the fields set in inner replaced
+func (o *routeOverride) merge(inner *routeOverride) *routeOverride {
+	merged := *o
+	if inner.logBody != nil {
+		merged.logBody = inner.logBody
+	}
+	if inner.skip != nil {
+		merged.skip = inner.skip
+	}
+	if inner.samplingPercentage != nil {
+		merged.samplingPercentage = inner.samplingPercentage
+	}
+	if len(inner.masks) > 0 {
+		merged.masks = make(map[string][]string, len(o.masks)+len(inner.masks))
+		for _, masks := range []map[string][]string{o.masks, inner.masks} {
+			for fieldName, fields := range masks {
+				merged.masks[fieldName] = fields
+			}
+		}
+	}
+	if len(inner.identify) > 0 {
+		merged.identify = make(map[string]func(*gin.Context) string, len(o.identify)+len(inner.identify))
+		for _, identify := range []map[string]func(*gin.Context) string{o.identify, inner.identify} {
+			for fieldName, callback := range identify {
+				merged.identify[fieldName] = callback
+			}
+		}
+	}
+	return &merged
+}
+
+// lazyRequestBody buffers the request body for logging when it is first read, which is
+// after the Overrides of the route ran, so bodies that are not logged are not buffered.
+// A body read by a handler running before an Override is buffered as decided then.
+type lazyRequestBody struct {
+	c      *gin.Context
+	body   io.ReadCloser
+	timing *requestTiming
+	reader io.ReadCloser
+}
+
+func newLazyRequestBody(c *gin.Context, timing *requestTiming) *lazyRequestBody {
+	return &lazyRequestBody{c: c, body: c.Request.Body, timing: timing}
+}
+
+func (b *lazyRequestBody) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		b.buffer()
+	}
+	return b.reader.Read(p)
+}
+
+func (b *lazyRequestBody) Close() error {
+	if b.reader == nil {
+		return b.body.Close()
+	}
+	return b.reader.Close()
+}
+
+// buffer decides whether the body is logged and tees it if so, unless that was decided already
+func (b *lazyRequestBody) buffer() {
+	if b.reader != nil {
+		return
+	}
+	b.reader = b.body
+	if !capturesBodies(b.c) {
+		return
+	}
+	bodyReadStart := time.Now()
+	body1, body2, err := teeBody(b.body)
+	b.timing.bodyRead = time.Since(bodyReadStart)
+	if err != nil {
+		logger.Warn("Could not read request body", requestAttrs(b.c, "error", err)...)
+		return
+	}
+	// body1 replays the buffer for the handlers, body2 is read by the event
+	b.reader = body1
+	b.c.Set(requestBodyContextKey, body2)
+}
+
+// capturesBodies reports whether the bodies of the request are logged, as far as known
+// before its handlers return
+func capturesBodies(c *gin.Context) bool {
+	skip, _ := routeSkip(c)
+	return routeLogBody(c) && !sampledOut(c) && !skip
+}
+
+// updateBodyCapture starts or stops capturing the response body once an override or the
+// sampling changed whether it is logged
+func updateBodyCapture(c *gin.Context) {
+	if lgw, ok := c.Writer.(*logGinResponseWriter); ok {
+		lgw.discardBody = !capturesBodies(c)
+	}
+}
+
+// loggedRequestBody returns the request body buffered for logging, or nil
+func loggedRequestBody(c *gin.Context) io.ReadCloser {
+	body, _ := c.Get(requestBodyContextKey)
+	readCloser, _ := body.(io.ReadCloser)
+	return readCloser
+}
+
+func routeOverrideOf(c *gin.Context) *routeOverride {
+	value, _ := c.Get(overrideContextKey)
+	override, _ := value.(*routeOverride)
+	return override
+}
+
+// routeLogBody reports whether bodies are captured for the request
+func routeLogBody(c *gin.Context) bool {
+	if override := routeOverrideOf(c); override != nil && override.logBody != nil {
+		return *override.logBody
+	}
+	return logBody
+}
+
+// routeSkip reports whether the route skips events, and whether an override decided it
+func routeSkip(c *gin.Context) (skip bool, overridden bool) {
+	if override := routeOverrideOf(c); override != nil && override.skip != nil {
+		return *override.skip, true
+	}
+	return false, false
+}
+
+// routeMasks returns the fields to mask for the mask option fieldName
+func routeMasks(c *gin.Context, fieldName string) []string {
+	if override := routeOverrideOf(c); override != nil {
+		if fields, found := override.masks[fieldName]; found {
+			return fields
+		}
+	}
+	return configuredMasks(fieldName)
+}
+
+// routeIdentify returns the identification callback of the route for fieldName, or nil
+func routeIdentify(c *gin.Context, fieldName string) func(*gin.Context) string {
+	if override := routeOverrideOf(c); override != nil {
+		return override.identify[fieldName]
+	}
+	return nil
+}
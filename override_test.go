@@ -0,0 +1,64 @@
+package moesifgin
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOverrideBuffersOnlyLoggedBodies(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{})
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Data(200, "application/json", body)
+	}
+	r.POST("/logged", echo)
+	r.POST("/unread", func(c *gin.Context) { c.Status(204) })
+	r.Group("/quiet", Override(WithLogBody(false))).POST("", echo)
+	r.Group("/skipped", Override(WithSkip(true))).POST("", echo)
+
+	const payload = `{"name":"moesif"}`
+	tests := []struct {
+		path     string
+		buffered int64
+		events   int
+		logged   bool
+	}{
+		{"/logged", 2 * int64(len(payload)), 1, true},
+		{"/unread", int64(len(payload)), 1, true},
+		{"/quiet", 0, 1, false},
+		{"/skipped", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			before := atomic.LoadInt64(&metrics.bodyBytesBuffered)
+			eventsBefore := len(sink.Events())
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("POST", test.path, strings.NewReader(payload)))
+			if test.path != "/unread" && rec.Body.String() != payload {
+				t.Errorf("handler read %q, want the request body", rec.Body.String())
+			}
+
+			if buffered := atomic.LoadInt64(&metrics.bodyBytesBuffered) - before; buffered != test.buffered {
+				t.Errorf("buffered %d bytes, want %d", buffered, test.buffered)
+			}
+			events := sink.Events()[eventsBefore:]
+			if len(events) != test.events {
+				t.Fatalf("got %d events, want %d", len(events), test.events)
+			}
+			if test.events == 1 {
+				body := *events[0].Request.Body
+				if (body != nil) != test.logged {
+					t.Errorf("request body = %v, want logged %v", body, test.logged)
+				}
+				if (events[0].Response.Body != nil) != (test.logged && test.path != "/unread") {
+					t.Errorf("response body = %v, want logged %v", events[0].Response.Body, test.logged)
+				}
+			}
+		})
+	}
+}
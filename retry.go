@@ -0,0 +1,256 @@
+package moesifgin
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxSendAttempts         = 5
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = 30 * time.Second
+
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 5 * time.Minute
+)
+
+var (
+	maxSendAttempts = defaultMaxSendAttempts
+	breaker         = newCircuitBreaker(defaultCircuitBreakerThreshold, defaultCircuitBreakerCooldown)
+
+	errCircuitOpen = errors.New("moesif collector circuit breaker is open")
+)
+
+// collectorError is returned for collector responses outside of the 2xx range
+type collectorError struct {
+	Path       string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *collectorError) Error() string {
+	return fmt.Sprintf("moesif collector %s responded with status %d", e.Path, e.StatusCode)
+}
+
+// newCollectorError builds the error for a failed response, honoring its Retry-After header
+func newCollectorError(path string, resp *http.Response) *collectorError {
+	return &collectorError{
+		Path:       path,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// retryable reports whether a failed call may succeed if repeated, and how long the
+// collector asked us to wait before doing so
+func retryable(err error) (bool, time.Duration) {
+	var collectorErr *collectorError
+	if errors.As(err, &collectorErr) {
+		switch {
+		case collectorErr.StatusCode == http.StatusTooManyRequests,
+			collectorErr.StatusCode == http.StatusRequestTimeout,
+			collectorErr.StatusCode >= 500:
+			return true, collectorErr.RetryAfter
+		}
+		return false, 0
+	}
+	// Network errors and timeouts
+	return true, 0
+}
+
+// backoffDelay returns a jittered exponential delay for the given number of failures
+func backoffDelay(failures int) time.Duration {
+	wait := retryMinBackoff << uint(failures-1)
+	if wait > retryMaxBackoff || wait <= 0 {
+		wait = retryMaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// withRetry calls the collector until it succeeds, fails with an error that is not
+// retryable, runs out of attempts or the circuit breaker opens
+func withRetry(call func() error) error {
+	for attempt := 1; ; attempt++ {
+		if !breaker.allow() {
+			return errCircuitOpen
+		}
+		err := call()
+		canRetry, retryAfter := retryable(err)
+		breaker.record(err, canRetry, retryAfter)
+		if err == nil || !canRetry || attempt >= maxSendAttempts {
+			return err
+		}
+
+		wait := backoffDelay(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		logger.Debug("Moesif collector call failed, retrying", "attempt", attempt, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+	}
+}
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// circuitBreaker stops calls to the collector after consecutive failures. Once the
+// cooldown has passed a single probe call is let through, closing the breaker again
+// if it succeeds.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	threshold   int
+	cooldown    time.Duration
+	state       string
+	failures    int
+	openUntil   time.Time
+	probing     bool
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// configure updates the thresholds without resetting the breaker state
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.cooldown = cooldown
+}
+
+// allow reports whether a call may be made now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with the result of a call. Errors that are not retryable
+// show that the collector is reachable and do not count as failures.
+func (b *circuitBreaker) record(err error, canRetry bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil {
+		atomic.AddInt64(&metrics.sendFailures, 1)
+		b.lastError = err.Error()
+		b.lastErrorAt = time.Now()
+	}
+	if err == nil || !canRetry {
+		if err == nil {
+			b.lastSuccess = time.Now()
+		}
+		if b.state != CircuitClosed {
+			logger.Info("Moesif collector circuit breaker closed")
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		wait := b.cooldown
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if b.state != CircuitOpen {
+			logger.Warn("Moesif collector circuit breaker opened", "open_for", wait, "failures", b.failures, "error", err)
+		}
+		b.state = CircuitOpen
+		b.openUntil = time.Now().Add(wait)
+	}
+}
+
+// wait returns how long until the breaker lets a call through
+func (b *circuitBreaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != CircuitOpen {
+		return 0
+	}
+	return time.Until(b.openUntil)
+}
+
+// SenderStatus describes the health of the connection to the Moesif collector
+type SenderStatus struct {
+	CircuitState        string    `json:"circuit_state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorTime       time.Time `json:"last_error_time,omitempty"`
+	LastSuccessTime     time.Time `json:"last_success_time,omitempty"`
+	QueuedEvents        int       `json:"queued_events"`
+	DroppedEvents       int64     `json:"dropped_events"`
+}
+
+// GetSenderStatus returns the circuit breaker state and event queue statistics
+func GetSenderStatus() SenderStatus {
+	breaker.mu.Lock()
+	status := SenderStatus{
+		CircuitState:        breaker.state,
+		ConsecutiveFailures: breaker.failures,
+		LastError:           breaker.lastError,
+		LastErrorTime:       breaker.lastErrorAt,
+		LastSuccessTime:     breaker.lastSuccess,
+	}
+	if breaker.state == CircuitOpen {
+		status.OpenUntil = breaker.openUntil
+	}
+	breaker.mu.Unlock()
+
+	if sender != nil {
+		status.QueuedEvents = len(sender.queue)
+		status.DroppedEvents = sender.droppedEvents()
+	}
+	return status
+}
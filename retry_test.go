@@ -0,0 +1,148 @@
+package moesifgin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	errUnavailable := &collectorError{Path: "/v1/events/batch", StatusCode: 503}
+
+	tests := []struct {
+		name  string
+		probe error
+		want  string
+	}{
+		{"probe succeeds", nil, CircuitClosed},
+		{"probe fails", errUnavailable, CircuitOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, cooldown)
+			for i := 0; i < 3; i++ {
+				if b.state != CircuitClosed || !b.allow() {
+					t.Fatalf("breaker %s after %d failures, want closed", b.state, i)
+				}
+				b.record(errUnavailable, true, 0)
+			}
+			if b.state != CircuitOpen || b.allow() {
+				t.Fatalf("breaker %s after 3 failures, want open", b.state)
+			}
+
+			time.Sleep(cooldown)
+			if !b.allow() || b.state != CircuitHalfOpen {
+				t.Fatalf("breaker %s after the cooldown, want a half-open probe", b.state)
+			}
+			if b.allow() {
+				t.Error("breaker let a second probe through while half-open")
+			}
+			b.record(test.probe, true, 0)
+			if b.state != test.want {
+				t.Errorf("breaker %s after the probe, want %s", b.state, test.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerIgnoresErrorsThatAreNotRetryable(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.record(&collectorError{StatusCode: 400}, false, 0)
+	if b.state != CircuitClosed || b.failures != 0 {
+		t.Errorf("breaker %s with %d failures after a 400, want closed", b.state, b.failures)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "120", 120 * time.Second, 120 * time.Second},
+		{"zero seconds", "0", 0, 0},
+		{"negative seconds", "-5", 0, 0},
+		{"HTTP date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{"past HTTP date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+		{"malformed", "soon", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if wait := parseRetryAfter(test.value); wait < test.min || wait > test.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", test.value, wait, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retry     bool
+		waitAfter time.Duration
+	}{
+		{"400", &collectorError{StatusCode: 400}, false, 0},
+		{"401", &collectorError{StatusCode: 401}, false, 0},
+		{"404", &collectorError{StatusCode: 404, RetryAfter: time.Minute}, false, 0},
+		{"408", &collectorError{StatusCode: 408}, true, 0},
+		{"429", &collectorError{StatusCode: 429, RetryAfter: time.Minute}, true, time.Minute},
+		{"500", &collectorError{StatusCode: 500}, true, 0},
+		{"503", &collectorError{StatusCode: 503, RetryAfter: time.Second}, true, time.Second},
+		{"network error", errors.New("connection refused"), true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retry, wait := retryable(test.err)
+			if retry != test.retry || wait != test.waitAfter {
+				t.Errorf("retryable = %v, %s, want %v, %s", retry, wait, test.retry, test.waitAfter)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	defer func(b *circuitBreaker, attempts int) { breaker, maxSendAttempts = b, attempts }(breaker, maxSendAttempts)
+	maxSendAttempts = 2
+
+	tests := []struct {
+		status int
+		calls  int
+	}{
+		{400, 1},
+		{422, 1},
+		{429, 2},
+		{502, 2},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.status), func(t *testing.T) {
+			breaker = newCircuitBreaker(defaultCircuitBreakerThreshold, time.Minute)
+			calls := 0
+			err := withRetry(func() error {
+				calls++
+				return &collectorError{StatusCode: test.status}
+			})
+			if err == nil || calls != test.calls {
+				t.Errorf("withRetry made %d calls returning %v, want %d calls", calls, err, test.calls)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for failures := 1; failures <= 70; failures++ {
+		want := retryMinBackoff << uint(failures-1)
+		if want > retryMaxBackoff || want <= 0 {
+			want = retryMaxBackoff
+		}
+		for i := 0; i < 20; i++ {
+			if wait := backoffDelay(failures); wait < want/2 || wait > want || wait > retryMaxBackoff {
+				t.Fatalf("backoffDelay(%d) = %s, want between %s and %s", failures, wait, want/2, want)
+			}
+		}
+	}
+}
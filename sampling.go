@@ -0,0 +1,52 @@
+package moesifgin
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const samplingContextKey = "moesif.sampling"
+
+// samplingDecision is the sampling of a request decided before its handlers run, so
+// requests that are sampled out are not captured
+type samplingDecision struct {
+	percentage int
+	random     int
+	sampled    bool
+}
+
+// decideSampling rolls the dice for a sampling percentage
+func decideSampling(percentage int) *samplingDecision {
+	random := samplingRandom()
+	return &samplingDecision{percentage: percentage, random: random, sampled: percentage > random}
+}
+
+// upfrontSamplingPercentage returns the sampling percentage of the application config if
+// it does not depend on the user or company of the event, which are only known once the
+// handlers ran
+func upfrontSamplingPercentage() (int, bool) {
+	config := appConfig.Read()
+	if len(config.UserSampleRate) > 0 || len(config.CompanySampleRate) > 0 {
+		return 0, false
+	}
+	return config.SampleRate, true
+}
+
+// samplingDecisionOf returns the sampling decided for the request, or nil if it is decided
+// when the event is queued
+func samplingDecisionOf(c *gin.Context) *samplingDecision {
+	value, _ := c.Get(samplingContextKey)
+	decision, _ := value.(*samplingDecision)
+	return decision
+}
+
+// sampledOut reports whether the request was sampled out before its handlers ran
+func sampledOut(c *gin.Context) bool {
+	decision := samplingDecisionOf(c)
+	return decision != nil && !decision.sampled
+}
+
+// resample decides the sampling of a request again with the percentage of a route override
+func resample(c *gin.Context, percentage int) {
+	c.Set(samplingContextKey, decideSampling(percentage))
+	updateBodyCapture(c)
+}
@@ -0,0 +1,84 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSamplingBodyBuffering(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       AppConfigResponse
+		skipPre      bool
+		random       int
+		user         string
+		wantCaptured bool
+		wantBuffered bool
+		wantEvent    bool
+		wantWeight   int
+	}{
+		{
+			name:   "skipped before the handler",
+			config: AppConfigResponse{SampleRate: 100}, skipPre: true, random: 0,
+		},
+		{
+			name:   "sampled out up front",
+			config: AppConfigResponse{SampleRate: 50}, random: 50,
+			wantCaptured: true,
+		},
+		{
+			name:   "sampled in up front",
+			config: AppConfigResponse{SampleRate: 50}, random: 49,
+			wantCaptured: true, wantBuffered: true, wantEvent: true, wantWeight: 2,
+		},
+		{
+			// The user is only known after the handler, so the body is buffered and
+			// the event sampled out when it is queued
+			name:   "sampled out after the handler",
+			config: AppConfigResponse{SampleRate: 100, UserSampleRate: map[string]int{"user-1": 10}}, random: 10, user: "user-1",
+			wantCaptured: true, wantBuffered: true,
+		},
+		{
+			name:   "sampled in after the handler",
+			config: AppConfigResponse{SampleRate: 100, UserSampleRate: map[string]int{"user-1": 10}}, random: 10, user: "user-2",
+			wantCaptured: true, wantBuffered: true, wantEvent: true, wantWeight: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{
+				"Sampling_Random": func() int { return test.random },
+				"Should_Skip_Pre": func(c *gin.Context) bool { return test.skipPre },
+				"Identify_User":   func(c *gin.Context) string { return test.user },
+			})
+			appConfig.Write(test.config)
+
+			var captured, buffered bool
+			r.GET("/orders", func(c *gin.Context) {
+				c.String(200, "a response body")
+				lgw, ok := c.Writer.(*logGinResponseWriter)
+				captured = ok
+				buffered = ok && !lgw.discardBody && lgw.body.Len() > 0
+			})
+			bufferedBefore := atomic.LoadInt64(&metrics.bodyBytesBuffered)
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+
+			if captured != test.wantCaptured || buffered != test.wantBuffered {
+				t.Errorf("response captured %v, body buffered %v, want %v, %v", captured, buffered, test.wantCaptured, test.wantBuffered)
+			}
+			if grew := atomic.LoadInt64(&metrics.bodyBytesBuffered) > bufferedBefore; grew != test.wantBuffered {
+				t.Errorf("buffered body bytes grew %v, want %v", grew, test.wantBuffered)
+			}
+			events := sink.Events()
+			if (len(events) == 1) != test.wantEvent || len(events) > 1 {
+				t.Fatalf("got %d events, want an event %v", len(events), test.wantEvent)
+			}
+			if test.wantEvent && (events[0].Weight == nil || *events[0].Weight != test.wantWeight) {
+				t.Errorf("weight = %v, want %d", events[0].Weight, test.wantWeight)
+			}
+		})
+	}
+}
@@ -1,22 +1,46 @@
 package moesifgin
 
 import (
-	"log"
 	"math/rand"
 	"net/http"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/moesif/moesifapi-go/models"
 )
 
-// Queue Event to batch send to Moesif
-func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[string]interface{}, apiVersion *string, reqBody interface{}, reqEncoding *string, reqContentLength *int64,
+// samplingRandom returns a random percentage in [0, 100) to compare against the sampling
+// percentage. It can be replaced through the Sampling_Random option for reproducible tests.
+var samplingRandom = defaultSamplingRandom
+
+func defaultSamplingRandom() int {
+	return rand.Intn(100)
+}
+
+// samplingRandomOption reads the Sampling_Random option, a func() int or a *rand.Rand
+func samplingRandomOption(moesifOption map[string]interface{}) func() int {
+	switch random := moesifOption["Sampling_Random"].(type) {
+	case func() int:
+		return random
+	case *rand.Rand:
+		// rand.Rand is not safe for concurrent use
+		var mu sync.Mutex
+		return func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return random.Intn(100)
+		}
+	}
+	return defaultSamplingRandom
+}
+
+// newEvent builds an event from a captured request and response
+func newEvent(request *http.Request, ip string, reqTime time.Time, reqHeader map[string]interface{}, apiVersion *string, reqBody interface{}, reqEncoding *string, reqContentLength *int64,
 	rspTime time.Time, respStatus int, respHeader map[string]interface{}, respBody interface{}, respEncoding *string, respContentLength *int64,
 	userId string, companyId string, sessionToken *string, metadata map[string]interface{},
-	direction *string) {
+	direction *string) *models.EventModel {
 
-	ip := getClientIp(request)
 	uri := request.URL.Scheme + "://" + request.Host + request.URL.Path
 	if request.URL.RawQuery != "" {
 		uri += "?" + request.URL.RawQuery
@@ -43,10 +67,54 @@ func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[str
 		ContentLength:    respContentLength,
 	}
 
+	return &models.EventModel{
+		Request:      event_request,
+		Response:     event_response,
+		SessionToken: sessionToken,
+		Tags:         nil,
+		UserId:       &userId,
+		CompanyId:    &companyId,
+		Metadata:     metadata,
+		Direction:    direction,
+	}
+}
+
+// enrichEvent runs the event through the enrich pipeline if any, reporting whether it
+// should be sent
+func enrichEvent(event *models.EventModel, enrich func(*models.EventModel) bool) bool {
+	if enrich == nil || enrich(event) {
+		return true
+	}
+	atomic.AddInt64(&metrics.eventsSkipped, 1)
+	logger.Debug("Skipping event", "uri", event.Request.Uri, "reason", "enricher")
+	return false
+}
+
+// Queue Event to batch send to Moesif, after running it through the enrich pipeline if any.
+// sampling is the decision made before the handlers ran, or nil to decide now.
+func sendMoesifAsync(event *models.EventModel, enrich func(*models.EventModel) bool, sampling *samplingDecision) {
+	if !enrichEvent(event, enrich) {
+		return
+	}
+	uri := event.Request.Uri
+
+	var userId, companyId string
+	if event.UserId != nil {
+		userId = *event.UserId
+	}
+	if event.CompanyId != nil {
+		companyId = *event.CompanyId
+	}
+
 	// Parse sampling percentage based on user/company to decide if the event should be sent to Moesif
 	// This defaults to 100% meaning that all events are logged unless specifically configured otherwise
-	samplingPercentage := getSamplingPercentage(userId, companyId)
-	randomPercentage := rand.Intn(100)
+	var samplingPercentage, randomPercentage int
+	if sampling != nil {
+		samplingPercentage, randomPercentage = sampling.percentage, sampling.random
+	} else {
+		samplingPercentage = getSamplingPercentage(userId, companyId)
+		randomPercentage = samplingRandom()
+	}
 
 	if samplingPercentage > randomPercentage {
 		// Weight proportionate to sampling percentage
@@ -56,30 +124,19 @@ func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[str
 		} else {
 			eventWeight = 100 / samplingPercentage
 		}
+		event.Weight = &eventWeight
 
-		event := models.EventModel{
-			Request:      event_request,
-			Response:     event_response,
-			SessionToken: sessionToken,
-			Tags:         nil,
-			UserId:       &userId,
-			CompanyId:    &companyId,
-			Metadata:     metadata,
-			Direction:    direction,
-			Weight:       &eventWeight,
-		}
-
-		errSendEvent := apiClient.QueueEvent(&event)
+		errSendEvent := eventSink.QueueEvent(event)
 		if errSendEvent != nil {
-			log.Fatalf("Error while adding event to Moesif: %s.\n", errSendEvent.Error())
+			atomic.AddInt64(&metrics.eventsQueueErrors, 1)
+			logger.Error("Could not queue event", "uri", uri, "error", errSendEvent)
 		} else {
-			if debug {
-				log.Println("Event successfully added to the queue")
-			}
+			atomic.AddInt64(&metrics.eventsQueued, 1)
+			logger.Debug("Queued event", "uri", uri)
 		}
 	} else {
-		if debug {
-			log.Println("Skipped Event due to sampling percentage: " + strconv.Itoa(samplingPercentage) + " and random percentage: " + strconv.Itoa(randomPercentage))
-		}
+		atomic.AddInt64(&metrics.eventsSampledOut, 1)
+		logger.Debug("Skipping event", "uri", uri, "reason", "sampling",
+			"sampling_percentage", samplingPercentage, "random_percentage", randomPercentage)
 	}
 }
@@ -0,0 +1,312 @@
+package moesifgin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// EventSink receives the events, users, companies and subscriptions captured by the
+// middleware. Set the Event_Sink option to send them somewhere other than Moesif.
+type EventSink interface {
+	QueueEvent(event *models.EventModel) error
+	QueueUsers(users []*models.UserModel) error
+	QueueCompanies(companies []*models.CompanyModel) error
+	QueueSubscriptions(subscriptions []*models.SubscriptionModel) error
+	Flush() error
+	Close() error
+}
+
+// How long Flush and Close of the Moesif API sink wait for queued events to be sent
+const moesifSinkFlushTimeout = 30 * time.Second
+
+var (
+	eventSink   EventSink
+	synchronous bool
+)
+
+// moesifSink sends to the Moesif API. Events go through the spool when one is configured,
+// otherwise through the retrying event sender. Users, companies and subscriptions always
+// go through the event sender, they are not spooled. In synchronous mode everything is
+// sent before the Queue methods return.
+type moesifSink struct{}
+
+// NewMoesifSink returns the sink that sends to the Moesif API configured by the middleware options
+func NewMoesifSink() EventSink {
+	return moesifSink{}
+}
+
+func (moesifSink) QueueEvent(event *models.EventModel) error {
+	if synchronous {
+		return sendEventsBatch([]*models.EventModel{event})
+	}
+	if spool != nil {
+		errSpool := spool.Append(event)
+		if errSpool == nil {
+			return nil
+		}
+		logger.Warn("Could not write event to the spool, queueing it in memory instead", "error", errSpool)
+	}
+	return sender.QueueEvent(event)
+}
+
+func (moesifSink) QueueUsers(users []*models.UserModel) error {
+	if synchronous {
+		return withRetry(func() error { return postToCollector("/v1/users/batch", users) })
+	}
+	return sender.queueEntities("/v1/users/batch", users)
+}
+
+func (moesifSink) QueueCompanies(companies []*models.CompanyModel) error {
+	if synchronous {
+		return withRetry(func() error { return postToCollector("/v1/companies/batch", companies) })
+	}
+	return sender.queueEntities("/v1/companies/batch", companies)
+}
+
+func (moesifSink) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	if synchronous {
+		return withRetry(func() error { return postToCollector("/v1/subscriptions/batch", subscriptions) })
+	}
+	return sender.queueEntities("/v1/subscriptions/batch", subscriptions)
+}
+
+// Flush seals the spool segment being written and waits until the spool and the event
+// sender sent everything queued so far
+func (moesifSink) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), moesifSinkFlushTimeout)
+	defer cancel()
+	var errs []error
+	if spool != nil {
+		errs = append(errs, spool.flush(ctx))
+	}
+	errs = append(errs, sender.flush(ctx))
+	return errors.Join(errs...)
+}
+
+// Close flushes, then stops the spool and the event sender. Events queued afterwards are rejected.
+func (s moesifSink) Close() error {
+	err := s.Flush()
+	if spool != nil {
+		err = errors.Join(err, spool.close())
+	}
+	sender.close()
+	apiClient.Close()
+	return err
+}
+
+// sinkRecord is a single line written by the JSON Lines sinks
+type sinkRecord struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// WriterSink writes every record as a line of JSON to an io.Writer
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink writing JSON Lines to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewStdoutSink returns a sink writing JSON Lines to the standard output
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (s *WriterSink) write(recordType string, data interface{}) error {
+	line, err := json.Marshal(sinkRecord{Type: recordType, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *WriterSink) QueueEvent(event *models.EventModel) error {
+	return s.write("event", event)
+}
+
+func (s *WriterSink) QueueUsers(users []*models.UserModel) error {
+	for _, user := range users {
+		if err := s.write("user", user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) QueueCompanies(companies []*models.CompanyModel) error {
+	for _, company := range companies {
+		if err := s.write("company", company); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	for _, subscription := range subscriptions {
+		if err := s.write("subscription", subscription); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) Flush() error {
+	return nil
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes JSON Lines to a file, rotating it once it grows beyond a size limit.
+// Rotated files are renamed with a numeric suffix, path.1 being the most recent.
+type FileSink struct {
+	WriterSink
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens (or appends to) the file at path. A maxBytes of 0 disables rotation.
+// At least one backup is kept, so a maxBackups below 1 keeps path.1 only.
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	if maxBackups < 1 {
+		maxBackups = 1
+	}
+	s := &FileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	s.w = (*fileSinkWriter)(s)
+	return nil
+}
+
+// fileSinkWriter is the io.Writer of a FileSink. It is called with the WriterSink lock held.
+type fileSinkWriter FileSink
+
+func (w *fileSinkWriter) Write(p []byte) (int, error) {
+	s := (*FileSink)(w)
+	if s.file == nil {
+		return 0, os.ErrClosed
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(p)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the existing backups by one and starts a new file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// FanoutSink sends everything to several sinks
+type FanoutSink []EventSink
+
+// NewFanoutSink returns a sink forwarding to all of the given sinks
+func NewFanoutSink(sinks ...EventSink) FanoutSink {
+	return FanoutSink(sinks)
+}
+
+func (f FanoutSink) each(call func(EventSink) error) error {
+	var errs []error
+	for _, sink := range f {
+		if err := call(sink); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f FanoutSink) QueueEvent(event *models.EventModel) error {
+	return f.each(func(s EventSink) error { return s.QueueEvent(event) })
+}
+
+func (f FanoutSink) QueueUsers(users []*models.UserModel) error {
+	return f.each(func(s EventSink) error { return s.QueueUsers(users) })
+}
+
+func (f FanoutSink) QueueCompanies(companies []*models.CompanyModel) error {
+	return f.each(func(s EventSink) error { return s.QueueCompanies(companies) })
+}
+
+func (f FanoutSink) QueueSubscriptions(subscriptions []*models.SubscriptionModel) error {
+	return f.each(func(s EventSink) error { return s.QueueSubscriptions(subscriptions) })
+}
+
+func (f FanoutSink) Flush() error {
+	return f.each(func(s EventSink) error { return s.Flush() })
+}
+
+func (f FanoutSink) Close() error {
+	return f.each(func(s EventSink) error { return s.Close() })
+}
@@ -0,0 +1,126 @@
+package moesifgin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// readSinkURIs returns the URIs of the events written to a file sink file
+func readSinkURIs(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var uris []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record struct {
+			Data models.EventModel `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, record.Data.Request.Uri)
+	}
+	return uris
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		events     int
+		want       map[string]string // file suffix to the URIs it holds
+	}{
+		{
+			name:       "backups are numbered from the most recent",
+			maxBackups: 2,
+			events:     7,
+			want:       map[string]string{"": "[/7]", ".1": "[/5 /6]", ".2": "[/3 /4]"},
+		},
+		{
+			name:       "no backups keeps one",
+			maxBackups: 0,
+			events:     5,
+			want:       map[string]string{"": "[/5]", ".1": "[/3 /4]"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.jsonl")
+			// Measure a line to size the file for two events. Lines differ by a few
+			// bytes in their timestamps.
+			probe, err := NewFileSink(path, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			probe.QueueEvent(&models.EventModel{Request: models.EventRequestModel{Uri: "/0"}})
+			probe.Close()
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(path)
+
+			s, err := NewFileSink(path, info.Size()*5/2, test.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 1; i <= test.events; i++ {
+				if err := s.QueueEvent(&models.EventModel{Request: models.EventRequestModel{Uri: "/" + strconv.Itoa(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, _ := filepath.Glob(path + "*")
+			if len(files) != len(test.want) {
+				t.Errorf("got files %v, want %d", files, len(test.want))
+			}
+			for suffix, want := range test.want {
+				if uris := fmt.Sprint(readSinkURIs(t, path+suffix)); uris != want {
+					t.Errorf("events%s holds %s, want %s", suffix, uris, want)
+				}
+			}
+		})
+	}
+}
+
+// failingSink fails every call with err
+type failingSink struct {
+	err error
+}
+
+func (s failingSink) QueueEvent(*models.EventModel) error                  { return s.err }
+func (s failingSink) QueueUsers([]*models.UserModel) error                 { return s.err }
+func (s failingSink) QueueCompanies([]*models.CompanyModel) error          { return s.err }
+func (s failingSink) QueueSubscriptions([]*models.SubscriptionModel) error { return s.err }
+func (s failingSink) Flush() error                                         { return s.err }
+func (s failingSink) Close() error                                         { return s.err }
+
+func TestFanoutSinkJoinsErrors(t *testing.T) {
+	errFirst, errSecond := errors.New("first"), errors.New("second")
+	recorder := &testSink{}
+	fanout := NewFanoutSink(failingSink{errFirst}, recorder, failingSink{errSecond})
+
+	err := fanout.QueueEvent(&models.EventModel{})
+	if !errors.Is(err, errFirst) || !errors.Is(err, errSecond) {
+		t.Errorf("QueueEvent returned %v, want both errors", err)
+	}
+	if events := recorder.Events(); len(events) != 1 {
+		t.Errorf("sink after a failing sink got %d events, want 1", len(events))
+	}
+	if err := NewFanoutSink(recorder).Flush(); err != nil {
+		t.Errorf("Flush without failing sinks returned %v", err)
+	}
+}
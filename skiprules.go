@@ -0,0 +1,203 @@
+package moesifgin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SkipRule skips the events of requests matching all of its non-empty fields. Each field
+// matches if any of its values does.
+type SkipRule struct {
+	// URL paths as globs, where * matches within a path segment and ** across segments,
+	// e.g. /healthz or /static/**, or as regular expressions prefixed with "regex:"
+	Paths []string
+	// Gin route templates, e.g. /users/:id
+	Routes []string
+	// Request methods, e.g. OPTIONS
+	Methods []string
+	// Response status codes, classes or inclusive ranges, e.g. 404, 3xx or 500-503
+	Statuses []string
+	// Regular expressions matched against the User-Agent header, e.g. ^kube-probe/
+	UserAgents []string
+}
+
+// skipRule is a SkipRule with its patterns compiled
+type skipRule struct {
+	paths      []*regexp.Regexp
+	routes     []string
+	methods    []string
+	statuses   []statusPattern
+	userAgents []*regexp.Regexp
+}
+
+// statusPattern matches the status codes from min to max inclusive
+type statusPattern struct {
+	min, max int
+}
+
+var skipRules []skipRule
+
+// skipRulesOption reads the Skip_Rules option, ignoring rules with invalid patterns
+func skipRulesOption(moesifOption map[string]interface{}) []skipRule {
+	rules, _ := moesifOption["Skip_Rules"].([]SkipRule)
+	var compiled []skipRule
+	for _, rule := range rules {
+		if c, err := compileSkipRule(rule); err != nil {
+			logger.Error("Ignoring invalid skip rule", "rule", fmt.Sprintf("%+v", rule), "error", err)
+		} else {
+			compiled = append(compiled, c)
+		}
+	}
+	return compiled
+}
+
+func compileSkipRule(rule SkipRule) (skipRule, error) {
+	if len(rule.Paths)+len(rule.Routes)+len(rule.Methods)+len(rule.Statuses)+len(rule.UserAgents) == 0 {
+		return skipRule{}, fmt.Errorf("the rule is empty and would skip every event")
+	}
+	compiled := skipRule{routes: rule.Routes}
+	for _, path := range rule.Paths {
+		pattern, isRegex := strings.CutPrefix(path, "regex:")
+		if !isRegex {
+			pattern = globPattern(path)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return skipRule{}, err
+		}
+		compiled.paths = append(compiled.paths, re)
+	}
+	for _, method := range rule.Methods {
+		compiled.methods = append(compiled.methods, strings.ToUpper(method))
+	}
+	for _, status := range rule.Statuses {
+		pattern, err := parseStatusPattern(status)
+		if err != nil {
+			return skipRule{}, err
+		}
+		compiled.statuses = append(compiled.statuses, pattern)
+	}
+	for _, userAgent := range rule.UserAgents {
+		re, err := regexp.Compile(userAgent)
+		if err != nil {
+			return skipRule{}, err
+		}
+		compiled.userAgents = append(compiled.userAgents, re)
+	}
+	return compiled, nil
+}
+
+// globPattern converts a path glob to an anchored regular expression
+func globPattern(glob string) string {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return pattern.String()
+}
+
+// parseStatusPattern parses a status code such as 404, a class such as 5xx or a range
+// such as 500-503
+func parseStatusPattern(status string) (statusPattern, error) {
+	if len(status) == 3 && strings.EqualFold(status[1:], "xx") && status[0] >= '1' && status[0] <= '5' {
+		class := int(status[0]-'0') * 100
+		return statusPattern{min: class, max: class + 99}, nil
+	}
+	if from, to, isRange := strings.Cut(status, "-"); isRange {
+		min, minErr := parseStatusCode(from)
+		max, maxErr := parseStatusCode(to)
+		if minErr != nil || maxErr != nil || min > max {
+			return statusPattern{}, fmt.Errorf("invalid status range %q", status)
+		}
+		return statusPattern{min: min, max: max}, nil
+	}
+	code, err := parseStatusCode(status)
+	if err != nil {
+		return statusPattern{}, err
+	}
+	return statusPattern{min: code, max: code}, nil
+}
+
+func parseStatusCode(status string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(status))
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("invalid status %q", status)
+	}
+	return code, nil
+}
+
+func (p statusPattern) matches(status int) bool {
+	return status >= p.min && status <= p.max
+}
+
+// matchesRequest reports whether the request matches the rule, ignoring statuses
+func (r skipRule) matchesRequest(c *gin.Context) bool {
+	if len(r.paths) > 0 && !anyRegexp(r.paths, c.Request.URL.Path) {
+		return false
+	}
+	if len(r.routes) > 0 && !contains(r.routes, c.FullPath()) {
+		return false
+	}
+	if len(r.methods) > 0 && !contains(r.methods, c.Request.Method) {
+		return false
+	}
+	if len(r.userAgents) > 0 && !anyRegexp(r.userAgents, c.Request.UserAgent()) {
+		return false
+	}
+	return true
+}
+
+func (r skipRule) matchesStatus(status int) bool {
+	for _, pattern := range r.statuses {
+		if pattern.matches(status) {
+			return true
+		}
+	}
+	return len(r.statuses) == 0
+}
+
+func anyRegexp(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipBeforeHandler reports whether a rule without statuses matches the request, so it is
+// skipped before its body is buffered
+func skipBeforeHandler(c *gin.Context) bool {
+	for _, rule := range skipRules {
+		if len(rule.statuses) == 0 && rule.matchesRequest(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipAfterHandler reports whether a rule with statuses matches the request and response
+func skipAfterHandler(c *gin.Context, status int) bool {
+	for _, rule := range skipRules {
+		if len(rule.statuses) > 0 && rule.matchesRequest(c) && rule.matchesStatus(status) {
+			return true
+		}
+	}
+	return false
+}
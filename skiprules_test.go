@@ -0,0 +1,144 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"/healthz", "/healthz", true},
+		{"/healthz", "/healthz/live", false},
+		{"/static/*", "/static/app.js", true},
+		{"/static/*", "/static/js/app.js", false},
+		{"/static/**", "/static/js/app.js", true},
+		{"/static/**", "/static", false},
+		{"/users/*/orders", "/users/42/orders", true},
+		{"/users/*/orders", "/users/42/7/orders", false},
+		{"/users/**/orders", "/users/42/7/orders", true},
+		{"/v?/users", "/v1/users", true},
+		{"/v?/users", "/v10/users", false},
+		{"/file.json", "/fileXjson", false},
+		{"/a+b(c)", "/a+b(c)", true},
+	}
+	for _, test := range tests {
+		t.Run(test.glob+" "+test.path, func(t *testing.T) {
+			if match := regexp.MustCompile(globPattern(test.glob)).MatchString(test.path); match != test.match {
+				t.Errorf("%s matches %s = %v, want %v", test.glob, test.path, match, test.match)
+			}
+		})
+	}
+}
+
+func TestParseStatusPattern(t *testing.T) {
+	tests := []struct {
+		status   string
+		min, max int
+		invalid  bool
+	}{
+		{status: "404", min: 404, max: 404},
+		{status: "4xx", min: 400, max: 499},
+		{status: "5XX", min: 500, max: 599},
+		{status: "500-599", min: 500, max: 599},
+		{status: "500-500", min: 500, max: 500},
+		{status: "", invalid: true},
+		{status: "abc", invalid: true},
+		{status: "99", invalid: true},
+		{status: "600", invalid: true},
+		{status: "6xx", invalid: true},
+		{status: "0xx", invalid: true},
+		{status: "4x", invalid: true},
+		{status: "599-500", invalid: true},
+		{status: "500-", invalid: true},
+		{status: "-500", invalid: true},
+		{status: "500-600", invalid: true},
+		{status: "500-550-599", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			pattern, err := parseStatusPattern(test.status)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("parseStatusPattern(%q) = %+v, want an error", test.status, pattern)
+				}
+				return
+			}
+			if err != nil || pattern.min != test.min || pattern.max != test.max {
+				t.Errorf("parseStatusPattern(%q) = %+v, %v, want %d-%d", test.status, pattern, err, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestSkipRulesBeforeAndAfterHandler(t *testing.T) {
+	defer func() { skipRules = nil }()
+	skipRules = skipRulesOption(map[string]interface{}{"Skip_Rules": []SkipRule{
+		{Paths: []string{"/healthz"}},
+		{Paths: []string{"/orders/**"}, Statuses: []string{"404"}},
+	}})
+
+	tests := []struct {
+		path   string
+		status int
+		before bool
+		after  bool
+	}{
+		{"/healthz", 200, true, false},
+		// A rule with statuses only applies once the response is known
+		{"/orders/1", 404, false, true},
+		{"/orders/1", 200, false, false},
+		{"/users/1", 404, false, false},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", test.path, nil)
+		if before := skipBeforeHandler(c); before != test.before {
+			t.Errorf("%s skipped before the handler = %v, want %v", test.path, before, test.before)
+		}
+		if after := skipAfterHandler(c, test.status); after != test.after {
+			t.Errorf("%s %d skipped after the handler = %v, want %v", test.path, test.status, after, test.after)
+		}
+	}
+}
+
+func TestSkipRulesMiddleware(t *testing.T) {
+	r, sink := newTestEngine(t, map[string]interface{}{
+		"Skip_Rules": []SkipRule{
+			{Paths: []string{"/healthz"}},
+			{Routes: []string{"/orders/:id"}, Statuses: []string{"4xx"}},
+			// Empty and invalid rules are ignored
+			{},
+			{Statuses: []string{"7xx"}},
+		},
+	})
+	var observed bool
+	r.GET("/healthz", func(c *gin.Context) {
+		_, observed = c.Writer.(*logGinResponseWriter)
+		c.String(200, "ok")
+	})
+	r.GET("/orders/:id", func(c *gin.Context) {
+		if c.Param("id") == "0" {
+			c.Status(404)
+			return
+		}
+		c.String(200, "order")
+	})
+
+	for _, path := range []string{"/healthz", "/orders/0", "/orders/1"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if observed {
+		t.Error("the response of a request skipped before the handler was captured")
+	}
+	events := sink.Events()
+	if len(events) != 1 || events[0].Request.Uri != "http://example.com/orders/1" {
+		t.Fatalf("got %d events, want only /orders/1", len(events))
+	}
+}
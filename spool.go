@@ -0,0 +1,425 @@
+package moesifgin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const (
+	// Sealed segments are complete and ready to be drained, the open segment is being appended to
+	spoolSealedExt = ".seg"
+	spoolOpenExt   = ".open"
+	// Checkpoint files hold the offset up to which a sealed segment has been sent
+	spoolAckExt = ".ack"
+
+	defaultSpoolMaxSegmentBytes = 4 * 1024 * 1024
+	defaultSpoolMaxSegmentAge   = 5 * time.Second
+	defaultSpoolMaxTotalBytes   = 256 * 1024 * 1024
+	defaultSpoolRetention       = 72 * time.Hour
+	defaultSpoolBatchSize       = 200
+
+	spoolFlushPollInterval = 100 * time.Millisecond
+)
+
+var errSpoolClosed = errors.New("moesif event spool is closed")
+
+// eventSpool is an on-disk write-ahead log of events. Events are appended to an open
+// segment file which is sealed once it reaches a size or age cap. A background drainer
+// replays sealed segments to the collector, backing off while it is unreachable.
+type eventSpool struct {
+	dir             string
+	maxSegmentBytes int64
+	maxSegmentAge   time.Duration
+	maxTotalBytes   int64
+	retention       time.Duration
+	batchSize       int
+	send            func([]*models.EventModel) error
+
+	mu          sync.Mutex
+	open        *os.File
+	openWriter  *bufio.Writer
+	openBytes   int64
+	openedAt    time.Time
+	lastSegment int64
+	closed      bool
+
+	sealed    chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// openSpool creates the spool directory, recovers segments left by a previous process
+// and starts the rotation and drain goroutines
+func openSpool(dir string, send func([]*models.EventModel) error) (*eventSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &eventSpool{
+		dir:             dir,
+		maxSegmentBytes: defaultSpoolMaxSegmentBytes,
+		maxSegmentAge:   defaultSpoolMaxSegmentAge,
+		maxTotalBytes:   defaultSpoolMaxTotalBytes,
+		retention:       defaultSpoolRetention,
+		batchSize:       defaultSpoolBatchSize,
+		send:            send,
+		sealed:          make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start runs the background goroutines once the spool is configured
+func (s *eventSpool) start() {
+	go s.rotateLoop()
+	go s.drainLoop()
+}
+
+// recover seals segments that were still open when the previous process stopped.
+// A partially written last line is skipped when the segment is drained.
+func (s *eventSpool) recover() error {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolOpenExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range matches {
+		sealedName := strings.TrimSuffix(name, spoolOpenExt) + spoolSealedExt
+		if err := os.Rename(name, sealedName); err != nil {
+			return err
+		}
+		logger.Debug("Recovered spool segment", "segment", filepath.Base(sealedName))
+	}
+	s.signalSealed()
+	return nil
+}
+
+// Append writes the event to the open segment, creating one if needed
+func (s *eventSpool) Append(event *models.EventModel) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSpoolClosed
+	}
+	if s.open == nil {
+		if err := s.newSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.openWriter.Write(line); err != nil {
+		return err
+	}
+	// Hand the line to the OS so it survives a process crash
+	if err := s.openWriter.Flush(); err != nil {
+		return err
+	}
+	s.openBytes += int64(len(line))
+	if s.openBytes >= s.maxSegmentBytes {
+		return s.seal()
+	}
+	return nil
+}
+
+// newSegment opens a new segment named after the current time, so segments sort in write order
+func (s *eventSpool) newSegment() error {
+	id := time.Now().UnixNano()
+	if id <= s.lastSegment {
+		id = s.lastSegment + 1
+	}
+	s.lastSegment = id
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolOpenExt)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.open = f
+	s.openWriter = bufio.NewWriter(f)
+	s.openBytes = 0
+	s.openedAt = time.Now()
+	return nil
+}
+
+// seal syncs and closes the open segment and makes it available to the drainer.
+// The caller must hold s.mu.
+func (s *eventSpool) seal() error {
+	if s.open == nil {
+		return nil
+	}
+	f := s.open
+	s.open, s.openWriter = nil, nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := os.Rename(name, strings.TrimSuffix(name, spoolOpenExt)+spoolSealedExt); err != nil {
+		return err
+	}
+	s.enforceLimits()
+	s.signalSealed()
+	return nil
+}
+
+func (s *eventSpool) signalSealed() {
+	select {
+	case s.sealed <- struct{}{}:
+	default:
+	}
+}
+
+// rotateLoop seals the open segment once it reaches the age cap
+func (s *eventSpool) rotateLoop() {
+	ticker := time.NewTicker(s.maxSegmentAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+		if s.open != nil && time.Since(s.openedAt) >= s.maxSegmentAge {
+			if err := s.seal(); err != nil {
+				logger.Warn("Could not seal spool segment", "error", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sealOpen seals the open segment so the drainer picks it up without waiting for the age cap
+func (s *eventSpool) sealOpen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seal()
+}
+
+// flush seals the open segment and waits until the drainer sent every sealed segment or
+// ctx is done
+func (s *eventSpool) flush(ctx context.Context) error {
+	if err := s.sealOpen(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(spoolFlushPollInterval)
+	defer ticker.Stop()
+	for len(s.sealedSegments()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return errSpoolClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// close seals the open segment and stops the rotation and drain loops. Segments that were
+// not sent yet stay on disk and are sent when the middleware starts again.
+func (s *eventSpool) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		err = s.seal()
+		s.closed = true
+		s.mu.Unlock()
+		close(s.stop)
+	})
+	return err
+}
+
+// sealedSegments returns the sealed segment paths, oldest first
+func (s *eventSpool) sealedSegments() []string {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSealedExt))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// enforceLimits removes the oldest sealed segments while the spool exceeds its total
+// size cap, and any segment older than the retention period
+func (s *eventSpool) enforceLimits() {
+	segments := s.sealedSegments()
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, name := range segments {
+		if info, err := os.Stat(name); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, name := range segments {
+		if total <= s.maxTotalBytes && !s.expired(name) {
+			break
+		}
+		logger.Warn("Dropping spool segment", "segment", filepath.Base(name), "reason", "spool_limit")
+		s.remove(name)
+		total -= sizes[i]
+	}
+}
+
+// expired reports whether a segment was created longer ago than the retention period
+func (s *eventSpool) expired(name string) bool {
+	id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), spoolSealedExt), 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(0, id)) > s.retention
+}
+
+func (s *eventSpool) remove(name string) {
+	os.Remove(name)
+	os.Remove(name + spoolAckExt)
+}
+
+// drainLoop replays sealed segments oldest first, backing off exponentially with
+// jitter while sending fails
+func (s *eventSpool) drainLoop() {
+	failures := 0
+	for {
+		segments := s.sealedSegments()
+		if len(segments) == 0 {
+			select {
+			case <-s.sealed:
+			case <-time.After(s.maxSegmentAge):
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+
+		if err := s.drain(segments[0]); err != nil {
+			failures++
+			wait := backoffDelay(failures)
+			if breakerWait := breaker.wait(); breakerWait > wait {
+				wait = breakerWait
+			}
+			logger.Debug("Could not drain spool segment, retrying", "segment", filepath.Base(segments[0]), "retry_in", wait, "error", err)
+			select {
+			case <-time.After(wait):
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+		failures = 0
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+// drain sends a sealed segment in batches from its checkpoint, recording progress after
+// every successful batch, and removes it once fully sent
+func (s *eventSpool) drain(name string) error {
+	if s.expired(name) {
+		logger.Warn("Dropping spool segment", "segment", filepath.Base(name), "reason", "expired")
+		s.remove(name)
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := readSpoolCheckpoint(name)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	batch := make([]*models.EventModel, 0, s.batchSize)
+	var pending int64
+
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := s.send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		offset += pending
+		pending = 0
+		if _, err := os.Stat(name); err != nil {
+			// The segment was dropped by the spool limits while it was being sent
+			return nil
+		}
+		return writeSpoolCheckpoint(name, offset)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline was cut short by a crash and is skipped
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pending += int64(len(line))
+		var event models.EventModel
+		if err := json.Unmarshal(line, &event); err != nil {
+			logger.Warn("Skipping malformed event in spool segment", "segment", filepath.Base(name), "error", err)
+			continue
+		}
+		batch = append(batch, &event)
+		if len(batch) >= s.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	s.remove(name)
+	return nil
+}
+
+func readSpoolCheckpoint(name string) int64 {
+	data, err := os.ReadFile(name + spoolAckExt)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return offset
+}
+
+// writeSpoolCheckpoint atomically replaces the checkpoint of a segment
+func writeSpoolCheckpoint(name string, offset int64) error {
+	tmp := name + spoolAckExt + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name+spoolAckExt)
+}
@@ -0,0 +1,163 @@
+package moesifgin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// writeSegment writes events for the given URIs to a spool segment and returns its
+// path and the length of each line
+func writeSegment(t *testing.T, dir string, created time.Time, ext string, uris ...string) (string, []int) {
+	t.Helper()
+	var data []byte
+	var lengths []int
+	for _, uri := range uris {
+		line, err := json.Marshal(&models.EventModel{Request: models.EventRequestModel{Uri: uri}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = append(line, '\n')
+		data = append(data, line...)
+		lengths = append(lengths, len(line))
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%020d%s", created.UnixNano(), ext))
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name, lengths
+}
+
+// openTestSpool opens a spool on dir recording the URIs of the events it sends
+func openTestSpool(t *testing.T, dir string) (*eventSpool, *[]string) {
+	t.Helper()
+	var sent []string
+	s, err := openSpool(dir, func(events []*models.EventModel) error {
+		for _, event := range events {
+			sent = append(sent, event.Request.Uri)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &sent
+}
+
+func TestSpoolRecoversTruncatedOpenSegment(t *testing.T) {
+	dir := t.TempDir()
+	name, _ := writeSegment(t, dir, time.Now(), spoolOpenExt, "/a", "/b")
+	// The process crashed while writing the third line
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"request":{"uri":"/c"`)
+	f.Close()
+
+	s, sent := openTestSpool(t, dir)
+	segments := s.sealedSegments()
+	if len(segments) != 1 {
+		t.Fatalf("got %d sealed segments after recovery, want 1", len(segments))
+	}
+	if err := s.drain(segments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(*sent) != "[/a /b]" {
+		t.Errorf("sent %v, want [/a /b]", *sent)
+	}
+	if segments := s.sealedSegments(); len(segments) != 0 {
+		t.Errorf("segments left after draining: %v", segments)
+	}
+}
+
+func TestSpoolResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	name, lengths := writeSegment(t, dir, time.Now(), spoolSealedExt, "/a", "/b", "/c")
+	// The first line was sent before the previous process stopped
+	if err := os.WriteFile(name+spoolAckExt, []byte(strconv.Itoa(lengths[0])), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, sent := openTestSpool(t, dir)
+	if err := s.drain(name); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(*sent) != "[/b /c]" {
+		t.Errorf("sent %v, want [/b /c]", *sent)
+	}
+	if _, err := os.Stat(name + spoolAckExt); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after draining: %v", err)
+	}
+}
+
+func TestSpoolLimitsDropOldestSegments(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		created       []time.Time
+		maxTotalBytes func(segmentBytes int64) int64
+		retention     time.Duration
+		want          []int // indexes of the segments kept
+	}{
+		{
+			name:          "within limits",
+			created:       []time.Time{now.Add(-3 * time.Second), now.Add(-2 * time.Second), now.Add(-time.Second)},
+			maxTotalBytes: func(n int64) int64 { return 3 * n },
+			retention:     time.Hour,
+			want:          []int{0, 1, 2},
+		},
+		{
+			name:          "total size",
+			created:       []time.Time{now.Add(-3 * time.Second), now.Add(-2 * time.Second), now.Add(-time.Second)},
+			maxTotalBytes: func(n int64) int64 { return 2 * n },
+			retention:     time.Hour,
+			want:          []int{1, 2},
+		},
+		{
+			name:          "retention",
+			created:       []time.Time{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Second)},
+			maxTotalBytes: func(n int64) int64 { return 3 * n },
+			retention:     time.Hour,
+			want:          []int{2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var names []string
+			var segmentBytes int64
+			for _, created := range test.created {
+				name, lengths := writeSegment(t, dir, created, spoolSealedExt, "/a", "/b")
+				os.WriteFile(name+spoolAckExt, []byte(strconv.Itoa(lengths[0])), 0o644)
+				names = append(names, name)
+				segmentBytes = int64(lengths[0] + lengths[1])
+			}
+
+			s, _ := openTestSpool(t, dir)
+			s.maxTotalBytes = test.maxTotalBytes(segmentBytes)
+			s.retention = test.retention
+			s.enforceLimits()
+
+			var kept []int
+			for i, name := range names {
+				_, err := os.Stat(name)
+				_, ackErr := os.Stat(name + spoolAckExt)
+				if err == nil {
+					kept = append(kept, i)
+				} else if !os.IsNotExist(ackErr) {
+					t.Errorf("checkpoint of dropped segment %d left behind", i)
+				}
+			}
+			if fmt.Sprint(kept) != fmt.Sprint(test.want) {
+				t.Errorf("kept segments %v, want %v", kept, test.want)
+			}
+		})
+	}
+}
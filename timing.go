@@ -0,0 +1,129 @@
+package moesifgin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const timingContextKey = "moesif.timing"
+
+var serverTiming bool
+
+// requestTiming records where the time of a request went
+type requestTiming struct {
+	mu           sync.Mutex
+	start        time.Time
+	bodyRead     time.Duration
+	handlerStart time.Time
+	handlerEnd   time.Time
+	firstByte    time.Time
+	spans        []timingSpan
+}
+
+// timingSpan is a named part of the handler time, recorded with Mark
+type timingSpan struct {
+	name     string
+	duration time.Duration
+}
+
+func newRequestTiming(start time.Time) *requestTiming {
+	return &requestTiming{start: start}
+}
+
+// Mark starts a named span, e.g. "db", and returns the function that ends it. The
+// duration of every span is added to the event metadata and, if enabled, to the
+// Server-Timing header. Spans with the same name are summed.
+//
+//	defer moesifgin.Mark(c, "db")()
+func Mark(c *gin.Context, name string) func() {
+	value, found := c.Get(timingContextKey)
+	if !found {
+		return func() {}
+	}
+	timing := value.(*requestTiming)
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.spans = append(timing.spans, timingSpan{name: name, duration: time.Since(start)})
+		})
+	}
+}
+
+// writingHeader records the time to first byte and adds the Server-Timing header
+// if enabled. Spans still running at this point are left out of the header.
+func (t *requestTiming) writingHeader(header http.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.firstByte.IsZero() {
+		return
+	}
+	t.firstByte = time.Now()
+	if !serverTiming {
+		return
+	}
+	entries := []string{"app;dur=" + formatMillis(t.firstByte.Sub(t.start))}
+	if t.bodyRead > 0 {
+		entries = append(entries, "body;dur="+formatMillis(t.bodyRead))
+	}
+	for _, span := range t.spanTotals() {
+		entries = append(entries, fmt.Sprintf("%s;dur=%s", span.name, formatMillis(span.duration)))
+	}
+	header.Add("Server-Timing", strings.Join(entries, ", "))
+}
+
+// spanTotals sums the span durations by name, in the order the names were first seen
+func (t *requestTiming) spanTotals() []timingSpan {
+	var totals []timingSpan
+	index := make(map[string]int, len(t.spans))
+	for _, span := range t.spans {
+		if i, found := index[span.name]; found {
+			totals[i].duration += span.duration
+			continue
+		}
+		index[span.name] = len(totals)
+		totals = append(totals, span)
+	}
+	return totals
+}
+
+// metadata describes the latency breakdown for the event metadata, in milliseconds
+func (t *requestTiming) metadata(rspTime time.Time) map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := map[string]interface{}{
+		"total_ms":   millis(rspTime.Sub(t.start)),
+		"handler_ms": millis(t.handlerEnd.Sub(t.handlerStart)),
+	}
+	if !t.firstByte.IsZero() {
+		timing["ttfb_ms"] = millis(t.firstByte.Sub(t.start))
+	}
+	if t.bodyRead > 0 {
+		timing["request_body_read_ms"] = millis(t.bodyRead)
+	}
+	if len(t.spans) > 0 {
+		spans := make(map[string]interface{}, len(t.spans))
+		for _, span := range t.spanTotals() {
+			spans[span.name] = millis(span.duration)
+		}
+		timing["spans"] = spans
+	}
+	return timing
+}
+
+// millis converts a duration to milliseconds with microsecond precision
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(millis(d), 'f', -1, 64)
+}
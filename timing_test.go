@@ -0,0 +1,90 @@
+package moesifgin
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverTiming bool
+		handler      gin.HandlerFunc
+		wantHeader   []string
+	}{
+		{
+			name:         "body",
+			serverTiming: true,
+			handler:      func(c *gin.Context) { c.String(200, "ok") },
+			wantHeader:   []string{"app;dur=", "db;dur="},
+		},
+		{
+			name:         "status only",
+			serverTiming: true,
+			handler:      func(c *gin.Context) { c.Status(204) },
+			// The header is written once the handlers returned
+			wantHeader: []string{"app;dur=", "db;dur=", "render;dur="},
+		},
+		{
+			name:         "flushed stream",
+			serverTiming: true,
+			handler: func(c *gin.Context) {
+				c.Header("Content-Type", "text/event-stream")
+				c.Writer.Flush()
+				c.Writer.WriteString("data: 1\n\n")
+			},
+			wantHeader: []string{"app;dur=", "db;dur="},
+		},
+		{
+			name:    "disabled",
+			handler: func(c *gin.Context) { c.String(200, "ok") },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, sink := newTestEngine(t, map[string]interface{}{"Server_Timing": test.serverTiming})
+			r.GET("/orders", func(c *gin.Context) {
+				for i := 0; i < 2; i++ {
+					end := Mark(c, "db")
+					time.Sleep(time.Millisecond)
+					end()
+				}
+				// Still running when the header is written
+				defer Mark(c, "render")()
+				test.handler(c)
+			})
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", "/orders", nil))
+
+			// Result has the header as it was when the response was first written
+			header := recorder.Result().Header.Get("Server-Timing")
+			for _, want := range test.wantHeader {
+				if !strings.Contains(header, want) {
+					t.Errorf("Server-Timing = %q, want %s", header, want)
+				}
+			}
+			if (header != "") != (len(test.wantHeader) > 0) || strings.Count(header, ";dur=") != len(test.wantHeader) {
+				t.Errorf("Server-Timing = %q, want %v", header, test.wantHeader)
+			}
+
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			timing := events[0].Metadata.(map[string]interface{})["moesif_timing"].(map[string]interface{})
+			spans, _ := timing["spans"].(map[string]interface{})
+			if db, _ := spans["db"].(float64); db < 2 || spans["render"] == nil {
+				t.Errorf("spans = %v, want db of at least 2ms and render", spans)
+			}
+			for _, key := range []string{"total_ms", "handler_ms", "ttfb_ms"} {
+				if _, found := timing[key].(float64); !found {
+					t.Errorf("moesif_timing = %v, want %s", timing, key)
+				}
+			}
+		})
+	}
+}
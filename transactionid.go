@@ -0,0 +1,152 @@
+package moesifgin
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTransactionIdHeader = "X-Moesif-Transaction-Id"
+	// gin.Context key under which the resolved transaction id is stored
+	transactionIdContextKey = "moesif.transactionId"
+	// Inbound ids longer than this are never trusted
+	maxTransactionIdLength = 128
+)
+
+var (
+	transactionIdHeader    = defaultTransactionIdHeader
+	transactionIdGenerator = uuidV4
+	trustTransactionId     = func(c *gin.Context, transactionId string) bool { return true }
+)
+
+// TransactionID returns the transaction id assigned to the request by the middleware,
+// or an empty string if transaction ids are disabled or the middleware has not run.
+func TransactionID(c *gin.Context) string {
+	return c.GetString(transactionIdContextKey)
+}
+
+// Initialize the transaction id header, generator and trust rules from the options
+func transactionIdOptions(moesifOption map[string]interface{}) {
+	transactionIdHeader = defaultTransactionIdHeader
+	if header, found := moesifOption["Transaction_Id_Header"].(string); found && header != "" {
+		transactionIdHeader = header
+	}
+
+	transactionIdGenerator = uuidV4
+	switch generator := moesifOption["Transaction_Id_Generator"].(type) {
+	case string:
+		switch strings.ToLower(generator) {
+		case "uuidv7":
+			transactionIdGenerator = uuidV7
+		case "ulid":
+			transactionIdGenerator = ulid
+		case "uuidv4":
+		default:
+			logger.Warn("Unknown Transaction_Id_Generator, using UUIDv4", "generator", generator)
+		}
+	case func() string:
+		transactionIdGenerator = func() (string, error) { return generator(), nil }
+	case func() (string, error):
+		transactionIdGenerator = generator
+	case nil:
+	default:
+		logger.Warn("Unsupported Transaction_Id_Generator type, using UUIDv4", "type", fmt.Sprintf("%T", generator))
+	}
+
+	trustTransactionId = func(c *gin.Context, transactionId string) bool { return true }
+	switch trust := moesifOption["Trust_Transaction_Id"].(type) {
+	case bool:
+		trustTransactionId = func(c *gin.Context, transactionId string) bool { return trust }
+	case func(*gin.Context, string) bool:
+		trustTransactionId = trust
+	}
+}
+
+// resolveTransactionId returns the inbound transaction id if it is trusted,
+// otherwise a newly generated one
+func resolveTransactionId(c *gin.Context) string {
+	transactionId := c.Request.Header.Get(transactionIdHeader)
+	if len(transactionId) != 0 && validTransactionId(transactionId) && trustTransactionId(c, transactionId) {
+		return transactionId
+	}
+	transactionId, err := transactionIdGenerator()
+	if err != nil {
+		return ""
+	}
+	return transactionId
+}
+
+// validTransactionId rejects ids that are too long or contain characters
+// outside of visible ASCII
+func validTransactionId(transactionId string) bool {
+	if len(transactionId) > maxTransactionIdLength {
+		return false
+	}
+	for i := 0; i < len(transactionId); i++ {
+		if transactionId[i] <= ' ' || transactionId[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatUUID formats 16 bytes in the canonical 8-4-4-4-12 form
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hex.EncodeToString(b[0:4]), hex.EncodeToString(b[4:6]),
+		hex.EncodeToString(b[6:8]), hex.EncodeToString(b[8:10]), hex.EncodeToString(b[10:]))
+}
+
+// Function to generate a random (version 4) RFC 4122 UUID
+func uuidV4() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return formatUUID(b), nil
+}
+
+// Function to generate a time-ordered (version 7) UUID
+func uuidV7() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(b[0:6], ms[2:])
+	b[6] = (b[6] & 0x0f) | 0x70 // version 7
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return formatUUID(b), nil
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Function to generate a ULID (48 bit timestamp followed by 80 random bits)
+func ulid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(b[0:6], ms[2:])
+
+	// 128 bits encoded as 26 characters of 5 bits, the first carrying only 3 bits
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordBase32[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(out), nil
+}
@@ -0,0 +1,169 @@
+package moesifgin
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTransactionIdGeneratorOption(t *testing.T) {
+	var logs bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	defer func() { logger = previous }()
+
+	tests := []struct {
+		generator interface{}
+		length    int
+		warns     bool
+	}{
+		{nil, 36, false},
+		{"uuidv4", 36, false},
+		{"UUIDv7", 36, false},
+		{"ulid", 26, false},
+		{func() string { return "custom" }, 6, false},
+		{"uuid7", 36, true},
+		{42, 36, true},
+	}
+	for _, test := range tests {
+		logs.Reset()
+		transactionIdOptions(map[string]interface{}{"Transaction_Id_Generator": test.generator})
+		id, err := transactionIdGenerator()
+		if err != nil || len(id) != test.length {
+			t.Errorf("%v generated %q, %v, want an id of length %d", test.generator, id, err, test.length)
+		}
+		if warned := strings.Contains(logs.String(), "level=WARN"); warned != test.warns {
+			t.Errorf("%v logged %q, want a warning %v", test.generator, logs.String(), test.warns)
+		}
+	}
+	transactionIdOptions(map[string]interface{}{})
+}
+
+func TestUUIDVersionAndVariant(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator func() (string, error)
+		version   string
+	}{
+		{"uuidv4", uuidV4, "4"},
+		{"uuidv7", uuidV7, "7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-` + test.version + `[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+			for i := 0; i < 100; i++ {
+				id, err := test.generator()
+				if err != nil || !format.MatchString(id) {
+					t.Fatalf("generated %q, %v, want a version %s RFC 4122 UUID", id, err, test.version)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeOrderedIds(t *testing.T) {
+	crockford := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	tests := []struct {
+		name      string
+		generator func() (string, error)
+		// timestamp returns the milliseconds encoded in an id
+		timestamp func(t *testing.T, id string) int64
+	}{
+		{"uuidv7", uuidV7, func(t *testing.T, id string) int64 {
+			ms, err := strconv.ParseInt(strings.ReplaceAll(id[:13], "-", ""), 16, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ms
+		}},
+		{"ulid", ulid, func(t *testing.T, id string) int64 {
+			if !crockford.MatchString(id) {
+				t.Fatalf("generated %q, want 26 Crockford base32 characters", id)
+			}
+			var ms int64
+			for _, char := range id[:10] {
+				ms = ms<<5 | int64(strings.IndexRune(crockfordBase32, char))
+			}
+			return ms
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := time.Now().UnixMilli()
+			first, err := test.generator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now().UnixMilli()
+			if ms := test.timestamp(t, first); ms < before || ms > after {
+				t.Errorf("%s encodes %d, want a time between %d and %d", first, ms, before, after)
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			second, err := test.generator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.timestamp(t, second) <= test.timestamp(t, first) || second <= first {
+				t.Errorf("%s generated after %s does not sort after it", second, first)
+			}
+		})
+	}
+}
+
+func TestTransactionIdTrust(t *testing.T) {
+	const inbound = "inbound-id-1"
+	tests := []struct {
+		name     string
+		trust    interface{}
+		header   string
+		reusesId bool
+	}{
+		{"trusted by default", nil, inbound, true},
+		{"trusted", true, inbound, true},
+		{"not trusted", false, inbound, false},
+		{"trusted by function", func(c *gin.Context, id string) bool { return strings.HasPrefix(id, "inbound-") }, inbound, true},
+		{"rejected by function", func(c *gin.Context, id string) bool { return false }, inbound, false},
+		{"longest trusted", true, strings.Repeat("a", maxTransactionIdLength), true},
+		{"too long", true, strings.Repeat("a", maxTransactionIdLength+1), false},
+		{"space", true, "inbound id", false},
+		{"control character", true, "inbound\x01id", false},
+		{"non-ASCII", true, "inbound-é", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := newTestEngine(t, map[string]interface{}{"Trust_Transaction_Id": test.trust})
+			var handlerId string
+			r.GET("/", func(c *gin.Context) {
+				handlerId = TransactionID(c)
+				c.Status(204)
+			})
+
+			request := httptest.NewRequest("GET", "/", nil)
+			request.Header[defaultTransactionIdHeader] = []string{test.header}
+			response := httptest.NewRecorder()
+			r.ServeHTTP(response, request)
+
+			if handlerId == "" || response.Header().Get(defaultTransactionIdHeader) != handlerId {
+				t.Fatalf("TransactionID = %q, response header %q, want the same id", handlerId, response.Header().Get(defaultTransactionIdHeader))
+			}
+			if reused := handlerId == test.header; reused != test.reusesId {
+				t.Errorf("inbound id %q reused = %v, want %v", test.header, reused, test.reusesId)
+			}
+		})
+	}
+}
+
+func TestTransactionIDWithoutMiddleware(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if id := TransactionID(c); id != "" {
+		t.Errorf("TransactionID = %q without the middleware, want empty", id)
+	}
+}
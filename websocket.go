@@ -0,0 +1,409 @@
+package moesifgin
+
+import (
+	"bufio"
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+const (
+	// Maximum number of payload bytes kept for each sampled WebSocket message
+	webSocketSampleMaxBytes = 1024
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpClose        = 0x8
+)
+
+var (
+	captureWebSocket        bool
+	webSocketSampleMessages int
+)
+
+// isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(request.Header.Get("Connection")), "upgrade")
+}
+
+// webSocketSession tracks a hijacked WebSocket connection and sends a summary event
+// once the connection is closed and the middleware has identified the request
+type webSocketSession struct {
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	inbound  wsFrameParser // client to server
+	outbound wsFrameParser // server to client
+	closed   bool
+	skipped  bool
+
+	// Event fields resolved by the middleware after the handler returns
+	identified     bool
+	request        *http.Request
+	clientIp       string
+	requestHeader  map[string]interface{}
+	responseHeader map[string]interface{}
+	apiVersion     *string
+	userId         *string
+	companyId      *string
+	sessionToken   *string
+	tags           *string
+	metadata       map[string]interface{}
+	// Sampling decided before the upgrade handler ran, nil to decide when queueing
+	sampling *samplingDecision
+	// Body masks applied to the sampled messages, and whether bodies are logged at all
+	inboundMasks  []string
+	outboundMasks []string
+	logBody       bool
+}
+
+func newWebSocketSession() *webSocketSession {
+	return &webSocketSession{}
+}
+
+// wrap replaces the hijacked connection and its buffered reader and writer with ones
+// that observe the WebSocket frames in both directions
+func (s *webSocketSession) wrap(conn net.Conn, rw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+	s.mu.Lock()
+	s.start = time.Now().UTC()
+	s.mu.Unlock()
+
+	// The handshake response is written on the hijacked connection before any frames
+	s.outbound.handshake = true
+	ws := &webSocketConn{Conn: conn, reader: rw.Reader, session: s}
+	return ws, bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+}
+
+// identify records the fields of the enriched upgrade event for the summary. The captured
+// request must not be modified once the middleware returns.
+func (s *webSocketSession) identify(captured *capturedEvent, upgrade *models.EventModel) {
+	s.mu.Lock()
+	s.identified = true
+	s.request = captured.request
+	s.clientIp = *upgrade.Request.IpAddress
+	s.requestHeader, _ = upgrade.Request.Headers.(map[string]interface{})
+	s.responseHeader, _ = upgrade.Response.Headers.(map[string]interface{})
+	s.apiVersion = upgrade.Request.ApiVersion
+	s.userId = upgrade.UserId
+	s.companyId = upgrade.CompanyId
+	s.sessionToken = upgrade.SessionToken
+	s.tags = upgrade.Tags
+	s.metadata, _ = upgrade.Metadata.(map[string]interface{})
+	s.sampling = captured.sampling
+	s.inboundMasks = captured.reqBodyMasks
+	s.outboundMasks = captured.respBodyMasks
+	s.logBody = captured.captureBody
+	s.mu.Unlock()
+	s.maybeSend()
+}
+
+// skip discards the session so no summary event is sent
+func (s *webSocketSession) skip() {
+	s.mu.Lock()
+	s.skipped = true
+	s.mu.Unlock()
+}
+
+func (s *webSocketSession) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.end = time.Now().UTC()
+	s.mu.Unlock()
+	s.maybeSend()
+}
+
+// maybeSend sends the session summary once both the connection is closed and the
+// request has been identified
+func (s *webSocketSession) maybeSend() {
+	s.mu.Lock()
+	if !s.closed || !s.identified || s.skipped || s.start.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.skipped = true // Only ever send the summary once
+	summary := map[string]interface{}{
+		"duration_ms": s.end.Sub(s.start).Milliseconds(),
+		"inbound":     s.inbound.summary(s.logBody, s.inboundMasks),
+		"outbound":    s.outbound.summary(s.logBody, s.outboundMasks),
+	}
+	metadata := addMetadata(s.metadata, "moesif_websocket", summary)
+	s.mu.Unlock()
+
+	logger.Debug("Sending WebSocket session summary", "url", s.request.URL.String())
+	var reqEncoding, respEncoding string
+	direction := "Incoming"
+	event := newEvent(s.request, s.clientIp, s.start, s.requestHeader, s.apiVersion, nil, &reqEncoding, nil,
+		s.end, http.StatusSwitchingProtocols, s.responseHeader, nil, &respEncoding, nil,
+		"", "", s.sessionToken, metadata, &direction)
+	event.UserId, event.CompanyId, event.Tags = s.userId, s.companyId, s.tags
+	sendMoesifAsync(event, nil, s.sampling)
+}
+
+// webSocketConn wraps a hijacked net.Conn, feeding the bytes read and written to the
+// session's frame parsers
+type webSocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	session   *webSocketSession
+	closeOnce sync.Once
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	// Read through the hijacked reader so bytes buffered before the hijack are observed
+	n, err := c.reader.Read(b)
+	if n > 0 {
+		c.session.mu.Lock()
+		c.session.inbound.feed(b[:n])
+		c.session.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.session.mu.Lock()
+		c.session.outbound.feed(b[:n])
+		c.session.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.session.close)
+	return err
+}
+
+// wsFrameParser incrementally parses RFC 6455 frames written in one direction
+type wsFrameParser struct {
+	handshake     bool // skipping an HTTP handshake until the blank line
+	handshakeEnd  int  // number of bytes of "\r\n\r\n" matched so far
+	handshakeSeen bool
+
+	header    []byte
+	inFrame   bool
+	remaining uint64
+	opcode    byte
+	fin       bool
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	messageOpcode   byte
+	sample          []byte
+	sampleTruncated bool
+	samples         []wsMessageSample
+	closePayload    []byte
+
+	frames        int
+	messages      int
+	controlFrames int
+	wireBytes     int64
+	payloadBytes  int64
+	closeCode     int
+}
+
+// wsHeaderLen returns the full header length once enough of the header is known, or 0
+func wsHeaderLen(header []byte) int {
+	if len(header) < 2 {
+		return 0
+	}
+	n := 2
+	switch header[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if header[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (p *wsFrameParser) feed(data []byte) {
+	if p.handshake && !p.handshakeSeen && len(data) > 0 {
+		// The handshake may already have been written through the ResponseWriter
+		p.handshakeSeen = true
+		p.handshake = data[0] == 'H'
+	}
+	for p.handshake && len(data) > 0 {
+		if data[0] == "\r\n\r\n"[p.handshakeEnd] {
+			p.handshakeEnd++
+		} else if data[0] == '\r' {
+			p.handshakeEnd = 1
+		} else {
+			p.handshakeEnd = 0
+		}
+		data = data[1:]
+		p.handshake = p.handshakeEnd < 4
+	}
+	p.wireBytes += int64(len(data))
+	for len(data) > 0 {
+		if !p.inFrame {
+			p.header = append(p.header, data[0])
+			data = data[1:]
+			if n := wsHeaderLen(p.header); n == 0 || len(p.header) < n {
+				continue
+			}
+			p.startFrame()
+			continue
+		}
+		n := uint64(len(data))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		p.payload(data[:n])
+		data = data[n:]
+		p.remaining -= n
+		if p.remaining == 0 {
+			p.endFrame()
+		}
+	}
+}
+
+func (p *wsFrameParser) startFrame() {
+	h := p.header
+	p.fin = h[0]&0x80 != 0
+	p.opcode = h[0] & 0x0f
+	p.masked = h[1]&0x80 != 0
+	p.maskPos = 0
+	i := 2
+	switch h[1] & 0x7f {
+	case 126:
+		p.remaining = uint64(binary.BigEndian.Uint16(h[2:4]))
+		i = 4
+	case 127:
+		p.remaining = binary.BigEndian.Uint64(h[2:10])
+		i = 10
+	default:
+		p.remaining = uint64(h[1] & 0x7f)
+	}
+	if p.masked {
+		copy(p.mask[:], h[i:i+4])
+	}
+	p.header = p.header[:0]
+	p.inFrame = true
+	if p.opcode != wsOpContinuation && p.opcode < wsOpClose {
+		p.messageOpcode = p.opcode
+	}
+	if p.remaining == 0 {
+		p.endFrame()
+	}
+}
+
+func (p *wsFrameParser) payload(data []byte) {
+	p.payloadBytes += int64(len(data))
+	closing := p.opcode == wsOpClose
+	sampling := p.opcode < wsOpClose && len(p.samples) < webSocketSampleMessages
+	if !sampling && !closing {
+		return
+	}
+	for _, b := range data {
+		if p.masked {
+			b ^= p.mask[p.maskPos%4]
+			p.maskPos++
+		}
+		if closing {
+			// The first two bytes of a close frame payload carry the status code
+			if len(p.closePayload) < 2 {
+				p.closePayload = append(p.closePayload, b)
+			}
+		} else if len(p.sample) < webSocketSampleMaxBytes {
+			p.sample = append(p.sample, b)
+		} else {
+			p.sampleTruncated = true
+		}
+	}
+}
+
+func (p *wsFrameParser) endFrame() {
+	p.inFrame = false
+	p.frames++
+	if p.opcode >= wsOpClose {
+		p.controlFrames++
+		if p.opcode == wsOpClose && len(p.closePayload) == 2 {
+			p.closeCode = int(binary.BigEndian.Uint16(p.closePayload))
+		}
+		return
+	}
+	if !p.fin {
+		return
+	}
+	p.messages++
+	if len(p.samples) < webSocketSampleMessages {
+		p.samples = append(p.samples, wsMessageSample{
+			opcode:    p.messageOpcode,
+			payload:   append([]byte(nil), p.sample...),
+			truncated: p.sampleTruncated,
+		})
+	}
+	p.sample = p.sample[:0]
+	p.sampleTruncated = false
+}
+
+// wsMessageSample is the start of a sampled message, masked when the summary is sent
+type wsMessageSample struct {
+	opcode    byte
+	payload   []byte
+	truncated bool
+}
+
+// value returns text payloads as strings and anything else base64 encoded. The fields in
+// masks are masked in JSON objects, like in bodies. A truncated JSON object cannot be
+// parsed to be masked, so it is replaced as a whole.
+func (m wsMessageSample) value(masks []string) interface{} {
+	payload := m.payload
+	if len(masks) > 0 {
+		var object map[string]interface{}
+		if err := json.Unmarshal(payload, &object); err == nil {
+			if masked, err := json.Marshal(maskData(object, masks)); err == nil {
+				payload = masked
+			}
+		} else if m.truncated && bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+			atomic.AddInt64(&metrics.fieldsMasked, 1)
+			return "*****"
+		}
+	}
+	if m.opcode == wsOpText && utf8.Valid(payload) {
+		return string(payload)
+	}
+	return b64.StdEncoding.EncodeToString(payload)
+}
+
+func (p *wsFrameParser) summary(logBody bool, masks []string) map[string]interface{} {
+	summary := map[string]interface{}{
+		"frames":         p.frames,
+		"messages":       p.messages,
+		"control_frames": p.controlFrames,
+		"bytes":          p.wireBytes,
+		"payload_bytes":  p.payloadBytes,
+	}
+	if p.closeCode != 0 {
+		summary["close_code"] = p.closeCode
+	}
+	if len(p.samples) > 0 && logBody {
+		samples := make([]interface{}, len(p.samples))
+		for i, sample := range p.samples {
+			samples[i] = sample.value(masks)
+		}
+		summary["sampled_messages"] = samples
+	}
+	return summary
+}
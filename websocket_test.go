@@ -0,0 +1,44 @@
+package moesifgin
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// wsTextFrame returns an unmasked text frame, as written by a server
+func wsTextFrame(payload string) []byte {
+	frame := []byte{0x80 | wsOpText}
+	if len(payload) < 126 {
+		frame = append(frame, byte(len(payload)))
+	} else {
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+func TestWebSocketSamplesAreMasked(t *testing.T) {
+	sampleMessages := webSocketSampleMessages
+	webSocketSampleMessages = 3
+	defer func() { webSocketSampleMessages = sampleMessages }()
+
+	var p wsFrameParser
+	p.feed(wsTextFrame(`{"token":"secret","n":1}`))
+	p.feed(wsTextFrame(`hello`))
+	p.feed(wsTextFrame(`{"token":"secret","padding":"` + strings.Repeat("x", 2*webSocketSampleMaxBytes) + `"}`))
+
+	summary := p.summary(true, []string{"token"})
+	want := []interface{}{`{"n":1,"token":"*****"}`, "hello", "*****"}
+	if samples := summary["sampled_messages"]; !reflect.DeepEqual(samples, want) {
+		t.Errorf("sampled_messages = %v, want %v", samples, want)
+	}
+
+	if samples, found := p.summary(false, nil)["sampled_messages"]; found {
+		t.Errorf("sampled_messages = %v without Log_Body", samples)
+	}
+	if samples := p.summary(true, nil)["sampled_messages"].([]interface{}); samples[0] != `{"token":"secret","n":1}` {
+		t.Errorf("sample = %v, want it unchanged without masks", samples[0])
+	}
+}